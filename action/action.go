@@ -0,0 +1,111 @@
+// Package action parses the command language of the actions of kbd grammars.
+//
+// An action is a script of commands separated by ';' or newlines, such as
+//
+//	cursor-line-end; insert '\n'; set mode vim-insert
+//
+// A command is a list of words separated by spaces, and its first word is
+// the name of the command. A word is made of text and substitutions:
+//
+//   - 'text' is literal text in which \\, \', \n, \r and \t are escapes
+//   - "text" may also contain substitutions and \" escapes
+//   - {text} is literal text that may contain balanced braces, such as a
+//     script to be run later
+//   - $name, $0, $1, ... are variables, and $1[0] is an element of a variable
+//   - [script] is replaced by the result of running the script
+//   - \c outside of quotes is the character c, and $$ is a dollar sign
+//
+// Bind parses the templates of the capture tree of an action, so that a host
+// can dispatch it without parsing its expanded command.
+//
+// A Registry declares the commands of a host, so that the actions of a
+// program can be checked when it is compiled rather than when they run.
+package action
+
+import (
+	"fmt"
+
+	"github.com/zyedidia/kbd"
+)
+
+// A Script is a sequence of commands.
+type Script struct {
+	Pos  int
+	Cmds []*Command
+}
+
+// A Command is a command name followed by its arguments.
+type Command struct {
+	Pos   int
+	Words []*Word
+}
+
+// Name returns the name of the command if its first word is literal text.
+func (c *Command) Name() (string, bool) {
+	return c.Words[0].Literal()
+}
+
+// Args returns the words that follow the name of the command.
+func (c *Command) Args() []*Word {
+	return c.Words[1:]
+}
+
+// A Word is the concatenation of its parts.
+type Word struct {
+	Pos   int
+	Parts []Part
+}
+
+// Literal returns the text of the word if it has no substitutions.
+func (w *Word) Literal() (string, bool) {
+	text := ""
+	for _, p := range w.Parts {
+		t, ok := p.(*Text)
+		if !ok {
+			return "", false
+		}
+		text += t.Text
+	}
+	return text, true
+}
+
+// A Part is a *Text, *Var or *Subst.
+type Part interface {
+	part()
+}
+
+// A Text is literal text, with the quotes and escapes removed.
+type Text struct {
+	Pos  int
+	Text string
+}
+
+// A Var is a reference to a variable. Index is the element of the variable
+// that is referred to, or -1 for the whole variable. Node is the capture bound
+// to the variable by Bind, if any.
+type Var struct {
+	Pos   int
+	Name  string
+	Index int
+	Node  *kbd.Node
+}
+
+// A Subst is a script whose result is substituted.
+type Subst struct {
+	Pos    int
+	Script *Script
+}
+
+func (*Text) part()  {}
+func (*Var) part()   {}
+func (*Subst) part() {}
+
+// An Error is a syntax error at byte offset Pos of the parsed action.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.Pos, e.Msg)
+}
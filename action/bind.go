@@ -0,0 +1,50 @@
+package action
+
+import (
+	"strconv"
+
+	"github.com/zyedidia/kbd"
+)
+
+// Bind parses the template of a node of the capture tree of an action (see
+// kbd.VM.SetTree) and binds its variables to the nodes of the arguments they
+// refer to: $1, $2, ... to the positional arguments and $name to the named
+// ones. The Node of other variables is nil: $0 is the value of 'n' itself and
+// the other names are variables of the host. Binding the nodes of the
+// arguments in turn gives the commands of the whole action, so that a host can
+// dispatch it without parsing its expanded command.
+func Bind(n *kbd.Node) (*Script, error) {
+	script, err := Parse(n.Template)
+	if err != nil {
+		return nil, err
+	}
+	bind(script, n)
+	return script, nil
+}
+
+func bind(script *Script, n *kbd.Node) {
+	for _, cmd := range script.Cmds {
+		for _, w := range cmd.Words {
+			for _, part := range w.Parts {
+				switch part := part.(type) {
+				case *Var:
+					part.Node = arg(n, part.Name)
+				case *Subst:
+					bind(part.Script, n)
+				}
+			}
+		}
+	}
+}
+
+// arg returns the argument of 'n' called 'name', or nil.
+func arg(n *kbd.Node, name string) *kbd.Node {
+	i, err := strconv.Atoi(name)
+	if err != nil {
+		return n.Named[name]
+	}
+	if i < 1 || i > len(n.Args) {
+		return nil
+	}
+	return n.Args[i-1]
+}
@@ -0,0 +1,55 @@
+package action
+
+import (
+	"testing"
+
+	"github.com/micro-editor/tcell/v2"
+	"github.com/zyedidia/kbd"
+)
+
+func TestBind(t *testing.T) {
+	g := kbd.Rules("top",
+		kbd.Rule{Name: "top", Pattern: kbd.Cap(kbd.Seq(kbd.Named("count", kbd.Plus(kbd.RangeRune('0', '9'))), kbd.Arg(kbd.NonTerm("move"))), "repeat -n $count [$2]; echo $pos")},
+		kbd.Rule{Name: "move", Pattern: kbd.Cap(kbd.Seq(kbd.MustKeys("f"), kbd.Arg(kbd.AnyRune())), "find-char $1")},
+	)
+	vm := kbd.NewVM(kbd.MustCompile(kbd.Seq(g, kbd.End())))
+	vm.SetTree(true)
+	var tree *kbd.Node
+	for _, r := range "12fx" {
+		if action, ok, _ := vm.Exec(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone)); ok {
+			tree = action.Tree
+		}
+	}
+	if tree == nil {
+		t.Fatal("no tree")
+	}
+
+	script, err := Bind(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repeat := script.Cmds[0]
+	if name, _ := repeat.Name(); name != "repeat" {
+		t.Fatalf("got command %q, expected repeat", name)
+	}
+	count := repeat.Words[2].Parts[0].(*Var)
+	if count.Node != tree.Named["count"] {
+		t.Fatalf("$count is bound to %v, expected %v", count.Node, tree.Named["count"])
+	}
+	move := repeat.Words[3].Parts[0].(*Subst).Script.Cmds[0].Words[0].Parts[0].(*Var)
+	if move.Node != tree.Args[1] {
+		t.Fatalf("$2 is bound to %v, expected %v", move.Node, tree.Args[1])
+	}
+	if pos := script.Cmds[1].Words[1].Parts[0].(*Var); pos.Node != nil {
+		t.Fatalf("$pos is bound to %v, expected nothing", pos.Node)
+	}
+
+	script, err = Bind(move.Node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	char := script.Cmds[0].Words[1].Parts[0].(*Var)
+	if char.Node == nil || char.Node.Value != 'x' {
+		t.Fatalf("$1 of find-char is bound to %v, expected the node of x", char.Node)
+	}
+}
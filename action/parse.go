@@ -0,0 +1,320 @@
+package action
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Parse parses an action. It returns an *Error if the action is malformed.
+func Parse(s string) (*Script, error) {
+	p := &parser{
+		s: s,
+	}
+	return p.script(-1)
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) *Error {
+	return &Error{
+		Pos: pos,
+		Msg: fmt.Sprintf(format, args...),
+	}
+}
+
+// script parses commands until the end of the action, or until the closing
+// bracket of the substitution opened at 'open' if it is not negative.
+func (p *parser) script(open int) (*Script, error) {
+	script := &Script{
+		Pos: p.pos,
+	}
+	for {
+		p.space()
+		if p.pos == len(p.s) {
+			if open >= 0 {
+				return nil, p.errorf(open, "unterminated substitution")
+			}
+			return script, nil
+		}
+		switch p.s[p.pos] {
+		case ';', '\n', '\r':
+			p.pos++
+			continue
+		case ']':
+			if open >= 0 {
+				return script, nil
+			}
+			return nil, p.errorf(p.pos, "unexpected ']'")
+		}
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		script.Cmds = append(script.Cmds, cmd)
+	}
+}
+
+func (p *parser) space() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// end reports whether the current command ends here.
+func (p *parser) end() bool {
+	return p.pos == len(p.s) || strings.IndexByte(";\n\r]", p.s[p.pos]) >= 0
+}
+
+func (p *parser) command() (*Command, error) {
+	cmd := &Command{
+		Pos: p.pos,
+	}
+	for !p.end() {
+		w, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+		cmd.Words = append(cmd.Words, w)
+		p.space()
+	}
+	return cmd, nil
+}
+
+func (p *parser) word() (*Word, error) {
+	w := &Word{
+		Pos: p.pos,
+	}
+	for !p.end() {
+		start := p.pos
+		switch c := p.s[p.pos]; c {
+		case ' ', '\t':
+			return w, nil
+		case '\'':
+			text, err := p.single()
+			if err != nil {
+				return nil, err
+			}
+			w.text(start, text)
+		case '"':
+			if err := p.double(w); err != nil {
+				return nil, err
+			}
+		case '{':
+			text, err := p.braced()
+			if err != nil {
+				return nil, err
+			}
+			w.text(start, text)
+		case '$':
+			w.add(p.variable())
+		case '[':
+			subst, err := p.subst()
+			if err != nil {
+				return nil, err
+			}
+			w.add(subst)
+		case '\\':
+			r, err := p.escape()
+			if err != nil {
+				return nil, err
+			}
+			w.text(start, string(r))
+		default:
+			for p.pos < len(p.s) && strings.IndexByte(" \t;\n\r]'\"{$[\\", p.s[p.pos]) < 0 {
+				p.pos++
+			}
+			w.text(start, p.s[start:p.pos])
+		}
+	}
+	return w, nil
+}
+
+// text appends literal text to the word, merging it with the previous text.
+func (w *Word) text(pos int, text string) {
+	if n := len(w.Parts); n > 0 {
+		if t, ok := w.Parts[n-1].(*Text); ok {
+			t.Text += text
+			return
+		}
+	}
+	w.add(&Text{
+		Pos:  pos,
+		Text: text,
+	})
+}
+
+func (w *Word) add(part Part) {
+	w.Parts = append(w.Parts, part)
+}
+
+// escape parses a backslash and the character it escapes.
+func (p *parser) escape() (rune, error) {
+	start := p.pos
+	p.pos++
+	if p.pos == len(p.s) {
+		return 0, p.errorf(start, "unterminated escape")
+	}
+	r, size := utf8.DecodeRuneInString(p.s[p.pos:])
+	p.pos += size
+	switch r {
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	}
+	return r, nil
+}
+
+func (p *parser) single() (string, error) {
+	start := p.pos
+	p.pos++
+	buf := &bytes.Buffer{}
+	for p.pos < len(p.s) {
+		switch c := p.s[p.pos]; c {
+		case '\'':
+			p.pos++
+			return buf.String(), nil
+		case '\\':
+			r, err := p.escape()
+			if err != nil {
+				return "", err
+			}
+			buf.WriteRune(r)
+		default:
+			buf.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", p.errorf(start, "unterminated string")
+}
+
+// double parses a string in double quotes and appends its parts to 'w'.
+func (p *parser) double(w *Word) error {
+	open := p.pos
+	p.pos++
+	for p.pos < len(p.s) {
+		start := p.pos
+		switch c := p.s[p.pos]; c {
+		case '"':
+			p.pos++
+			if len(w.Parts) == 0 {
+				// keep the empty string as a part of the word
+				w.text(open, "")
+			}
+			return nil
+		case '\\':
+			r, err := p.escape()
+			if err != nil {
+				return err
+			}
+			w.text(start, string(r))
+		case '$':
+			w.add(p.variable())
+		case '[':
+			subst, err := p.subst()
+			if err != nil {
+				return err
+			}
+			w.add(subst)
+		default:
+			for p.pos < len(p.s) && strings.IndexByte("\"\\$[", p.s[p.pos]) < 0 {
+				p.pos++
+			}
+			w.text(start, p.s[start:p.pos])
+		}
+	}
+	return p.errorf(open, "unterminated string")
+}
+
+// braced parses text in braces, which may contain balanced braces.
+func (p *parser) braced() (string, error) {
+	start := p.pos
+	depth := 0
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				p.pos++
+				return p.s[start+1 : p.pos-1], nil
+			}
+		case '\\':
+			// an escaped brace does not count
+			p.pos++
+		}
+		p.pos++
+	}
+	return "", p.errorf(start, "unterminated braces")
+}
+
+// variable parses a variable reference. A dollar sign that is not followed by
+// a name is literal text.
+func (p *parser) variable() Part {
+	start := p.pos
+	p.pos++
+	if p.pos < len(p.s) && p.s[p.pos] == '$' {
+		p.pos++
+		return &Text{
+			Pos:  start,
+			Text: "$",
+		}
+	}
+	for p.pos < len(p.s) {
+		r, size := utf8.DecodeRuneInString(p.s[p.pos:])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			break
+		}
+		p.pos += size
+	}
+	if p.pos == start+1 {
+		return &Text{
+			Pos:  start,
+			Text: "$",
+		}
+	}
+	v := &Var{
+		Pos:   start,
+		Name:  p.s[start+1 : p.pos],
+		Index: -1,
+	}
+	// a number in brackets right after the name is an index rather than a
+	// substitution
+	if p.pos < len(p.s) && p.s[p.pos] == '[' {
+		end := p.pos + 1
+		index := 0
+		for end < len(p.s) && p.s[end] >= '0' && p.s[end] <= '9' && index < 1e8 {
+			index = index*10 + int(p.s[end]-'0')
+			end++
+		}
+		if end > p.pos+1 && end < len(p.s) && p.s[end] == ']' {
+			v.Index = index
+			p.pos = end + 1
+		}
+	}
+	return v
+}
+
+func (p *parser) subst() (*Subst, error) {
+	open := p.pos
+	p.pos++
+	script, err := p.script(open)
+	if err != nil {
+		return nil, err
+	}
+	// script stopped at the closing bracket
+	p.pos++
+	return &Subst{
+		Pos:    open,
+		Script: script,
+	}, nil
+}
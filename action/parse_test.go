@@ -0,0 +1,124 @@
+package action
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/zyedidia/kbd"
+)
+
+func TestParse(t *testing.T) {
+	script, err := Parse(`cursor-to [find-next]; insert 'a b\n' "n=$1"; delete-range $pos $pos+$1[0]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &Script{
+		Pos: 0,
+		Cmds: []*Command{
+			{Pos: 0, Words: []*Word{
+				{Pos: 0, Parts: []Part{&Text{Pos: 0, Text: "cursor-to"}}},
+				{Pos: 10, Parts: []Part{&Subst{Pos: 10, Script: &Script{Pos: 11, Cmds: []*Command{
+					{Pos: 11, Words: []*Word{{Pos: 11, Parts: []Part{&Text{Pos: 11, Text: "find-next"}}}}},
+				}}}}},
+			}},
+			{Pos: 23, Words: []*Word{
+				{Pos: 23, Parts: []Part{&Text{Pos: 23, Text: "insert"}}},
+				{Pos: 30, Parts: []Part{&Text{Pos: 30, Text: "a b\n"}}},
+				{Pos: 38, Parts: []Part{&Text{Pos: 39, Text: "n="}, &Var{Pos: 41, Name: "1", Index: -1}}},
+			}},
+			{Pos: 46, Words: []*Word{
+				{Pos: 46, Parts: []Part{&Text{Pos: 46, Text: "delete-range"}}},
+				{Pos: 59, Parts: []Part{&Var{Pos: 59, Name: "pos", Index: -1}}},
+				{Pos: 64, Parts: []Part{
+					&Var{Pos: 64, Name: "pos", Index: -1},
+					&Text{Pos: 68, Text: "+"},
+					&Var{Pos: 69, Name: "1", Index: 0},
+				}},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(script, expect) {
+		t.Fatalf("got %+v, expected %+v", script, expect)
+	}
+}
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		action string
+		words  []string
+	}{
+		{`for { set i 0 } {incr {i}}`, []string{"for", " set i 0 ", "incr {i}"}},
+		{`exec 'd$' price $$5`, []string{"exec", "d$", "price", "$5"}},
+		{`insert '' a\ b 'it\'s'`, []string{"insert", "", "a b", "it's"}},
+		{`  spaced	out  `, []string{"spaced", "out"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			script, err := Parse(tt.action)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(script.Cmds) != 1 {
+				t.Fatalf("got %d commands", len(script.Cmds))
+			}
+			var words []string
+			for _, w := range script.Cmds[0].Words {
+				text, ok := w.Literal()
+				if !ok {
+					t.Fatalf("word at %d is not literal", w.Pos)
+				}
+				words = append(words, text)
+			}
+			if !reflect.DeepEqual(words, tt.words) {
+				t.Fatalf("got %q, expected %q", words, tt.words)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		action string
+		pos    int
+		msg    string
+	}{
+		{`insert 'abc`, 7, "unterminated string"},
+		{`insert "a [b]`, 7, "unterminated string"},
+		{`cursor-to [find`, 10, "unterminated substitution"},
+		{`quit]`, 4, "unexpected ']'"},
+		{`for {a {b}`, 4, "unterminated braces"},
+		{`insert \`, 7, "unterminated escape"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			_, err := Parse(tt.action)
+			var perr *Error
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected an *Error, got %v", err)
+			}
+			if perr.Pos != tt.pos || perr.Msg != tt.msg {
+				t.Fatalf("got %v, expected %d: %s", perr, tt.pos, tt.msg)
+			}
+		})
+	}
+}
+
+func TestQuoting(t *testing.T) {
+	values := []string{"", "word", "a b; c", "[cmd] $var {x}", `it's "quoted" \`, "tab\tnewline\n"}
+	for _, v := range values {
+		script, err := Parse("insert " + kbd.ActionQuoting.Quote(v))
+		if err != nil {
+			t.Fatalf("%q: %v", v, err)
+		}
+		words := script.Cmds[0].Args()
+		if len(words) != 1 {
+			t.Fatalf("%q: got %d words", v, len(words))
+		}
+		if text, ok := words[0].Literal(); !ok || text != v {
+			t.Fatalf("got %q, expected %q", text, v)
+		}
+	}
+}
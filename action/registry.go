@@ -0,0 +1,222 @@
+package action
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/zyedidia/kbd"
+)
+
+// A Type is the type of an argument of a command. Arguments that contain
+// substitutions are only known when the action runs, so they have every type.
+type Type int
+
+const (
+	// Any accepts any argument.
+	Any Type = iota
+	// Int accepts a decimal integer.
+	Int
+	// Literal accepts any text without substitutions, such as the name of a
+	// mode.
+	Literal
+)
+
+func (t Type) String() string {
+	switch t {
+	case Int:
+		return "an integer"
+	case Literal:
+		return "literal text"
+	}
+	return "anything"
+}
+
+// A Spec declares a command of the host.
+type Spec struct {
+	Name string
+	// Args are the types of the arguments.
+	Args []Type
+	// Optional is the number of trailing arguments that may be left out.
+	Optional int
+	// Variadic allows any number of arguments after Args, of the type of the
+	// last one.
+	Variadic bool
+}
+
+// A Registry is the set of commands known to a host, which is used to check
+// the actions of a program before running it.
+type Registry struct {
+	specs map[string]Spec
+}
+
+// NewRegistry returns a registry of the given commands.
+func NewRegistry(specs ...Spec) *Registry {
+	r := &Registry{
+		specs: make(map[string]Spec),
+	}
+	for _, spec := range specs {
+		r.Add(spec)
+	}
+	return r
+}
+
+// Add declares a command, replacing any command with the same name.
+func (r *Registry) Add(spec Spec) {
+	r.specs[spec.Name] = spec
+}
+
+// Lookup returns the declaration of a command.
+func (r *Registry) Lookup(name string) (Spec, bool) {
+	spec, ok := r.specs[name]
+	return spec, ok
+}
+
+// CheckScript returns the errors of the commands of a script, including the
+// scripts of its substitutions: unknown commands, wrong numbers of arguments
+// and arguments of the wrong type. Commands whose name is a substitution are
+// not checked.
+func (r *Registry) CheckScript(script *Script) []*Error {
+	var errs []*Error
+	for _, cmd := range script.Cmds {
+		errs = append(errs, r.checkCommand(cmd)...)
+		for _, w := range cmd.Words {
+			for _, part := range w.Parts {
+				if subst, ok := part.(*Subst); ok {
+					errs = append(errs, r.CheckScript(subst.Script)...)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func (r *Registry) checkCommand(cmd *Command) []*Error {
+	name, ok := cmd.Name()
+	if !ok {
+		return nil
+	}
+	spec, ok := r.specs[name]
+	if !ok {
+		return []*Error{{
+			Pos: cmd.Pos,
+			Msg: fmt.Sprintf("unknown command %q", name),
+		}}
+	}
+
+	args := cmd.Args()
+	min, max := len(spec.Args)-spec.Optional, len(spec.Args)
+	if len(args) < min || (len(args) > max && !spec.Variadic) {
+		return []*Error{{
+			Pos: cmd.Pos,
+			Msg: fmt.Sprintf("%s takes %s, got %d", name, arity(min, max, spec.Variadic), len(args)),
+		}}
+	}
+
+	var errs []*Error
+	for i, arg := range args {
+		if len(spec.Args) == 0 {
+			break
+		}
+		t := spec.Args[len(spec.Args)-1]
+		if i < len(spec.Args) {
+			t = spec.Args[i]
+		}
+		if !t.accepts(arg) {
+			errs = append(errs, &Error{
+				Pos: arg.Pos,
+				Msg: fmt.Sprintf("argument %d of %s must be %v", i+1, name, t),
+			})
+		}
+	}
+	return errs
+}
+
+func (t Type) accepts(w *Word) bool {
+	text, literal := w.Literal()
+	switch t {
+	case Int:
+		if !literal {
+			return true
+		}
+		_, err := strconv.Atoi(text)
+		return err == nil
+	case Literal:
+		return literal
+	}
+	return true
+}
+
+func arity(min, max int, variadic bool) string {
+	switch {
+	case variadic:
+		return "at least " + arguments(min)
+	case min == max:
+		return arguments(min)
+	}
+	return fmt.Sprintf("%d to %s", min, arguments(max))
+}
+
+func arguments(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
+}
+
+// A CheckError is an error in the action of a capture of a program.
+type CheckError struct {
+	Pos kbd.Pos
+	Msg string
+}
+
+func (e *CheckError) Error() string {
+	if pos := e.Pos.String(); pos != "" {
+		return pos + ": " + e.Msg
+	}
+	return e.Msg
+}
+
+// Check parses and checks the template of every capture of the program, and
+// returns the errors sorted by position. The position of an error is computed
+// from the position of its capture, so it is only known if the program was
+// compiled from a source that records them, such as a grammar compiled by
+// package syntax.
+func (r *Registry) Check(prog kbd.Program) []*CheckError {
+	var errs []*CheckError
+	seen := make(map[CheckError]bool)
+	add := func(c kbd.Capture, err *Error) {
+		e := CheckError{
+			Pos: c.PosOf(err.Pos),
+			Msg: err.Msg,
+		}
+		// a pattern that is used several times has several copies of its
+		// captures
+		if !seen[e] {
+			seen[e] = true
+			errs = append(errs, &e)
+		}
+	}
+
+	for _, c := range prog.Captures() {
+		script, err := Parse(c.Template)
+		if err != nil {
+			add(c, err.(*Error))
+			continue
+		}
+		for _, err := range r.CheckScript(script) {
+			add(c, err)
+		}
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		a, b := errs[i].Pos, errs[j].Pos
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return errs
+}
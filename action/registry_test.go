@@ -0,0 +1,74 @@
+package action
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zyedidia/kbd"
+)
+
+var registry = NewRegistry(
+	Spec{Name: "cursor-to", Args: []Type{Any}},
+	Spec{Name: "find-next"},
+	Spec{Name: "set", Args: []Type{Literal, Literal}},
+	Spec{Name: "word-front", Args: []Type{Literal, Int}, Optional: 2},
+	Spec{Name: "echo", Args: []Type{Any}, Variadic: true},
+)
+
+func TestCheckScript(t *testing.T) {
+	tests := []struct {
+		action string
+		errs   []string
+	}{
+		{"cursor-to [find-next]; set mode vim-insert", nil},
+		{"word-front; word-front -n 3; word-front -n $1; echo a b c", nil},
+		{"cursor-rigth $pos", []string{`0: unknown command "cursor-rigth"`}},
+		{"cursor-to [find-nxt]", []string{`11: unknown command "find-nxt"`}},
+		{"set mode", []string{"0: set takes 2 arguments, got 1"}},
+		{"cursor-to", []string{"0: cursor-to takes 1 argument, got 0"}},
+		{"word-front -n 3 4", []string{"0: word-front takes 0 to 2 arguments, got 3"}},
+		{"set mode $1", []string{"9: argument 2 of set must be literal text"}},
+		{"echo", []string{"0: echo takes at least 1 argument, got 0"}},
+		{"word-front -n three", []string{"14: argument 2 of word-front must be an integer"}},
+		{"set mode [mode]", []string{"9: argument 2 of set must be literal text", `10: unknown command "mode"`}},
+		{"$0; [find-next] x", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			script, err := Parse(tt.action)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var errs []string
+			for _, err := range registry.CheckScript(script) {
+				errs = append(errs, err.Error())
+			}
+			if !reflect.DeepEqual(errs, tt.errs) {
+				t.Fatalf("got %q, expected %q", errs, tt.errs)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	pos := kbd.Pos{Name: "test.kbd", Line: 3, Col: 10}
+	move := kbd.Cap(kbd.MustKeys("w"), "word-front -n x").At(pos)
+	p := kbd.Alt(
+		kbd.Cap(kbd.Plus(move), "cursor-to $1;\n  cursor-rigth").At(kbd.Pos{Name: "test.kbd", Line: 1, Col: 5}),
+		kbd.Cap(kbd.MustKeys("x"), "echo 'x"),
+	)
+
+	var errs []string
+	for _, err := range registry.Check(kbd.MustCompile(p)) {
+		errs = append(errs, err.Error())
+	}
+	expect := []string{
+		"unterminated string",
+		`test.kbd:2:3: unknown command "cursor-rigth"`,
+		"test.kbd:3:24: argument 2 of word-front must be an integer",
+	}
+	if !reflect.DeepEqual(errs, expect) {
+		t.Fatalf("got %q, expected %q", errs, expect)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/micro-editor/tcell/v2"
 )
@@ -255,12 +256,13 @@ DECODEPIECE:
 		}
 
 		// Decode rune
-		if len(piece) > 1 {
+		r, size := utf8.DecodeRuneInString(piece)
+		if r == utf8.RuneError || size != len(piece) {
 			return 0, 0, 0, fmt.Errorf("%s: %w", s, ErrInvalidKeyEvent)
 		}
 
 		key = tcell.KeyRune
-		ch = rune(piece[0])
+		ch = r
 	}
 
 	if mod&tcell.ModCtrl != 0 {
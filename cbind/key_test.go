@@ -17,6 +17,7 @@ var testCases = []testCase{
 	{mod: tcell.ModNone, key: tcell.KeyRune, ch: 'a', encoded: "a"},
 	{mod: tcell.ModNone, key: tcell.KeyRune, ch: '+', encoded: "+"},
 	{mod: tcell.ModNone, key: tcell.KeyRune, ch: ';', encoded: ";"},
+	{mod: tcell.ModNone, key: tcell.KeyRune, ch: 'é', encoded: "é"},
 	{mod: tcell.ModNone, key: tcell.KeyTab, ch: rune(tcell.KeyTab), encoded: "Tab"},
 	{mod: tcell.ModNone, key: tcell.KeyEnter, ch: rune(tcell.KeyEnter), encoded: "Enter"},
 	{mod: tcell.ModNone, key: tcell.KeyPgDn, ch: 0, encoded: "PageDown"},
@@ -0,0 +1,143 @@
+package cbind
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Leader is the key that the <leader> token stands for in key notation. It
+// must be a key accepted by Decode.
+var Leader = "\\"
+
+// A Token is a single key parsed from a key notation string. Key is written
+// in the form accepted by Decode and DecodeMouse, and Offset and Len locate
+// the token in the notation string.
+type Token struct {
+	Key    string
+	Offset int
+	Len    int
+}
+
+// A NotationError reports an invalid <...> token in a key notation string.
+type NotationError struct {
+	Token  string
+	Offset int
+	Err    error
+}
+
+func (e *NotationError) Error() string {
+	return fmt.Sprintf("%s at offset %d: %v", e.Token, e.Offset, e.Err)
+}
+
+func (e *NotationError) Unwrap() error {
+	return e.Err
+}
+
+// vim-style modifier prefixes and the modifier labels they stand for
+var notationMods = map[string]string{
+	"c":       LabelCtrl,
+	"ctrl":    LabelCtrl,
+	"control": LabelCtrl,
+	"m":       LabelAlt,
+	"a":       LabelAlt,
+	"alt":     LabelAlt,
+	"meta":    LabelMeta,
+	"s":       LabelShift,
+	"shift":   LabelShift,
+}
+
+// vim-style key names that Decode does not know about
+var notationKeys = map[string]string{
+	"lt":     "<",
+	"gt":     ">",
+	"bar":    "|",
+	"bslash": "\\",
+	"cr":     "enter",
+	"return": "enter",
+	"bs":     "backspace",
+	"del":    "delete",
+}
+
+// Tokenize splits a key notation string into keys. Each rune is a key of its
+// own, except for tokens written in angle brackets such as <esc>, <C-x>,
+// <M-a>, <S-Tab>, <ctrl-c>, <ctrl+w> or <leader>, which stand for a single
+// key. Modifiers may be separated by '-' or '+'. A '<' that does not start a
+// well-formed token (as in "<<") is an ordinary key.
+func Tokenize(s string) ([]Token, error) {
+	var toks []Token
+	for i := 0; i < len(s); {
+		if s[i] == '<' {
+			if j := strings.IndexByte(s[i+1:], '>'); j > 0 && isNotation(s[i+1:i+1+j]) {
+				tok := s[i : i+j+2]
+				key, err := decodeNotation(s[i+1 : i+1+j])
+				if err != nil {
+					return nil, &NotationError{
+						Token:  tok,
+						Offset: i,
+						Err:    err,
+					}
+				}
+				toks = append(toks, Token{
+					Key:    key,
+					Offset: i,
+					Len:    len(tok),
+				})
+				i += len(tok)
+				continue
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		toks = append(toks, Token{
+			Key:    string(r),
+			Offset: i,
+			Len:    size,
+		})
+		i += size
+	}
+	return toks, nil
+}
+
+func isNotation(body string) bool {
+	return !strings.ContainsAny(body, "< \t\n")
+}
+
+// decodeNotation converts the body of a <...> token into the form accepted by
+// Decode and verifies that it names a key.
+func decodeNotation(body string) (string, error) {
+	var mods []string
+	rest := body
+	for {
+		i := strings.IndexAny(rest, "-+")
+		if i <= 0 || i == len(rest)-1 {
+			break
+		}
+		mod, ok := notationMods[strings.ToLower(rest[:i])]
+		if !ok {
+			break
+		}
+		mods = append(mods, mod)
+		rest = rest[i+1:]
+	}
+
+	key := rest
+	lower := strings.ToLower(key)
+	if name, ok := notationKeys[lower]; ok {
+		key = name
+	} else if lower == "leader" {
+		key = Leader
+	} else if lower == "tab" && len(mods) == 1 && mods[0] == LabelShift {
+		// terminals report shift+tab as a separate key
+		mods, key = nil, "backtab"
+	}
+
+	norm := strings.Join(append(mods, key), "+")
+	if _, _, err := DecodeMouse(norm); err == nil {
+		return norm, nil
+	}
+	if _, _, _, err := Decode(norm); err != nil {
+		return "", ErrInvalidKeyEvent
+	}
+	return norm, nil
+}
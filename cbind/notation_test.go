@@ -0,0 +1,96 @@
+package cbind
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/micro-editor/tcell/v2"
+)
+
+type notationTestCase struct {
+	notation string
+	keys     []testCase
+}
+
+var notationTestCases = []notationTestCase{
+	{notation: "dd", keys: []testCase{
+		{mod: tcell.ModNone, key: tcell.KeyRune, ch: 'd'},
+		{mod: tcell.ModNone, key: tcell.KeyRune, ch: 'd'},
+	}},
+	{notation: "d<esc>", keys: []testCase{
+		{mod: tcell.ModNone, key: tcell.KeyRune, ch: 'd'},
+		{mod: tcell.ModNone, key: tcell.KeyEscape, ch: rune(tcell.KeyEscape)},
+	}},
+	{notation: "<C-x>", keys: []testCase{
+		{mod: tcell.ModCtrl, key: tcell.KeyCtrlX, ch: rune(tcell.KeyCtrlX)},
+	}},
+	{notation: "<ctrl-c>", keys: []testCase{
+		{mod: tcell.ModCtrl, key: tcell.KeyCtrlC, ch: rune(tcell.KeyCtrlC)},
+	}},
+	{notation: "<ctrl+w>", keys: []testCase{
+		{mod: tcell.ModCtrl, key: tcell.KeyCtrlW, ch: rune(tcell.KeyCtrlW)},
+	}},
+	{notation: "<M-a>", keys: []testCase{
+		{mod: tcell.ModAlt, key: tcell.KeyRune, ch: 'a'},
+	}},
+	{notation: "<S-Tab>", keys: []testCase{
+		{mod: tcell.ModNone, key: tcell.KeyBacktab, ch: 0},
+	}},
+	{notation: "<C-->", keys: []testCase{
+		{mod: tcell.ModCtrl, key: tcell.KeyRune, ch: '-'},
+	}},
+	{notation: "<leader>w", keys: []testCase{
+		{mod: tcell.ModNone, key: tcell.KeyRune, ch: '\\'},
+		{mod: tcell.ModNone, key: tcell.KeyRune, ch: 'w'},
+	}},
+	{notation: "<<", keys: []testCase{
+		{mod: tcell.ModNone, key: tcell.KeyRune, ch: '<'},
+		{mod: tcell.ModNone, key: tcell.KeyRune, ch: '<'},
+	}},
+	{notation: "<lt>>", keys: []testCase{
+		{mod: tcell.ModNone, key: tcell.KeyRune, ch: '<'},
+		{mod: tcell.ModNone, key: tcell.KeyRune, ch: '>'},
+	}},
+}
+
+func TestTokenize(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range notationTestCases {
+		toks, err := Tokenize(c.notation)
+		if err != nil {
+			t.Errorf("failed to tokenize %s: %s", c.notation, err)
+			continue
+		}
+		if len(toks) != len(c.keys) {
+			t.Errorf("failed to tokenize %s: got %d keys, want %d", c.notation, len(toks), len(c.keys))
+			continue
+		}
+		for i, tok := range toks {
+			mod, key, ch, err := Decode(tok.Key)
+			if err != nil {
+				t.Errorf("failed to decode token %s of %s: %s", tok.Key, c.notation, err)
+			}
+			k := c.keys[i]
+			if mod != k.mod || key != k.key || ch != k.ch {
+				t.Errorf("failed to tokenize %s: key %d: got %d %d %d, want %d %d %d", c.notation, i, mod, key, ch, k.mod, k.key, k.ch)
+			}
+		}
+	}
+}
+
+func TestTokenizeError(t *testing.T) {
+	t.Parallel()
+
+	_, err := Tokenize("ab<foo>c")
+	var nerr *NotationError
+	if !errors.As(err, &nerr) {
+		t.Fatalf("expected a notation error, got %v", err)
+	}
+	if nerr.Token != "<foo>" || nerr.Offset != 2 {
+		t.Errorf("got token %s at offset %d, want <foo> at offset 2", nerr.Token, nerr.Offset)
+	}
+	if !errors.Is(err, ErrInvalidKeyEvent) {
+		t.Errorf("expected ErrInvalidKeyEvent, got %v", err)
+	}
+}
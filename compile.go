@@ -1,21 +1,106 @@
 package kbd
 
 import (
+	"errors"
+	"fmt"
 	"math"
+	"sort"
+	"strings"
 
 	"github.com/zyedidia/gpeg/charset"
 )
 
+// A Pattern describes a set of event sequences and the actions they produce.
+// Compile returns an error if the pattern is malformed, for example if it
+// contains a nil pattern or a grammar references an undefined rule.
 type Pattern interface {
-	Compile() Program
+	Compile() (Program, error)
 }
 
+var (
+	// ErrEmpty is the error for an alternation, choice or sequence of zero
+	// patterns.
+	ErrEmpty = errors.New("empty list of patterns")
+	// ErrNil is the error for a nil pattern or event.
+	ErrNil = errors.New("nil pattern")
+	// ErrDuplicate is the error for a grammar rule that is defined twice.
+	ErrDuplicate = errors.New("rule defined twice")
+)
+
+// A RuleError is the error for a grammar rule that fails to compile.
+type RuleError struct {
+	Rule string
+	Err  error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("rule %s: %v", e.Rule, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// Compile compiles a pattern into a program for the VM. Unlike p.Compile, it
+// also reports an *UndefinedError for references to rules outside of any
+// grammar.
+func Compile(p Pattern) (Program, error) {
+	prog, err := compile(p)
+	if err != nil {
+		return nil, err
+	}
+	var undefined []string
+	for _, insn := range prog {
+		if t, ok := insn.(iOpenCall); ok {
+			undefined = append(undefined, t.name)
+		}
+	}
+	if len(undefined) > 0 {
+		sort.Strings(undefined)
+		return nil, &UndefinedError{
+			Names: undefined,
+		}
+	}
+	return prog, nil
+}
+
+func MustCompile(p Pattern) Program {
+	prog, err := Compile(p)
+	if err != nil {
+		panic(err)
+	}
+	return prog
+}
+
+// compile compiles a sub-pattern.
+func compile(p Pattern) (Program, error) {
+	if p == nil {
+		return nil, ErrNil
+	}
+	return p.Compile()
+}
+
+// An errNode is a pattern that fails to compile with an error. It is returned
+// by constructors that detect an error.
+type errNode struct {
+	err error
+}
+
+func (n *errNode) Compile() (Program, error) {
+	return nil, n.err
+}
+
+// An AltNode is an unordered alternation: both branches are tried in parallel
+// and whichever matches first wins.
 type AltNode struct {
 	s1 Pattern
 	s2 Pattern
 }
 
 func Alt(s ...Pattern) Pattern {
+	if len(s) == 0 {
+		return &errNode{ErrEmpty}
+	}
 	acc := s[len(s)-1]
 	for i := len(s) - 2; i >= 0; i-- {
 		acc = &AltNode{
@@ -27,15 +112,61 @@ func Alt(s ...Pattern) Pattern {
 	return acc
 }
 
-func (n *AltNode) Compile() Program {
-	p1 := n.s1.Compile()
-	p2 := n.s2.Compile()
+func (n *AltNode) Compile() (Program, error) {
+	p1, err := compile(n.s1)
+	if err != nil {
+		return nil, err
+	}
+	p2, err := compile(n.s2)
+	if err != nil {
+		return nil, err
+	}
 	var prog Program
 	prog = append(prog, iSplit{1, len(p1) + 2})
 	prog = append(prog, p1...)
 	prog = append(prog, iJump{len(p2) + 1})
 	prog = append(prog, p2...)
-	return prog
+	return prog, nil
+}
+
+// A ChoiceNode is a prioritized choice: like an AltNode both branches are
+// tried in parallel, but if both of them match, s1 wins. A match of s2 is held
+// back while s1 may still match.
+type ChoiceNode struct {
+	s1 Pattern
+	s2 Pattern
+}
+
+func Choice(s ...Pattern) Pattern {
+	if len(s) == 0 {
+		return &errNode{ErrEmpty}
+	}
+	acc := s[len(s)-1]
+	for i := len(s) - 2; i >= 0; i-- {
+		acc = &ChoiceNode{
+			s1: s[i],
+			s2: acc,
+		}
+	}
+
+	return acc
+}
+
+func (n *ChoiceNode) Compile() (Program, error) {
+	p1, err := compile(n.s1)
+	if err != nil {
+		return nil, err
+	}
+	p2, err := compile(n.s2)
+	if err != nil {
+		return nil, err
+	}
+	var prog Program
+	prog = append(prog, iChoice{1, len(p1) + 2})
+	prog = append(prog, p1...)
+	prog = append(prog, iJump{len(p2) + 1})
+	prog = append(prog, p2...)
+	return prog, nil
 }
 
 type SeqNode struct {
@@ -44,6 +175,9 @@ type SeqNode struct {
 }
 
 func Seq(s ...Pattern) Pattern {
+	if len(s) == 0 {
+		return &errNode{ErrEmpty}
+	}
 	acc := s[0]
 	for _, p := range s[1:] {
 		acc = &SeqNode{
@@ -55,13 +189,19 @@ func Seq(s ...Pattern) Pattern {
 	return acc
 }
 
-func (n *SeqNode) Compile() Program {
-	p1 := n.s1.Compile()
-	p2 := n.s2.Compile()
+func (n *SeqNode) Compile() (Program, error) {
+	p1, err := compile(n.s1)
+	if err != nil {
+		return nil, err
+	}
+	p2, err := compile(n.s2)
+	if err != nil {
+		return nil, err
+	}
 	var prog Program
 	prog = append(prog, p1...)
 	prog = append(prog, p2...)
-	return prog
+	return prog, nil
 }
 
 type StarNode struct {
@@ -74,13 +214,16 @@ func Star(s Pattern) *StarNode {
 	}
 }
 
-func (n *StarNode) Compile() Program {
-	p := n.s.Compile()
+func (n *StarNode) Compile() (Program, error) {
+	p, err := compile(n.s)
+	if err != nil {
+		return nil, err
+	}
 	var prog Program
 	prog = append(prog, iSplit{1, len(p) + 2})
 	prog = append(prog, p...)
 	prog = append(prog, iJump{-len(p) - 1})
-	return prog
+	return prog, nil
 }
 
 type PlusNode struct {
@@ -93,12 +236,15 @@ func Plus(s Pattern) *PlusNode {
 	}
 }
 
-func (n *PlusNode) Compile() Program {
-	p := n.s.Compile()
+func (n *PlusNode) Compile() (Program, error) {
+	p, err := compile(n.s)
+	if err != nil {
+		return nil, err
+	}
 	var prog Program
 	prog = append(prog, p...)
 	prog = append(prog, iSplit{-len(p), 1})
-	return prog
+	return prog, nil
 }
 
 type OptNode struct {
@@ -111,12 +257,15 @@ func Opt(s Pattern) *OptNode {
 	}
 }
 
-func (n *OptNode) Compile() Program {
-	p := n.s.Compile()
+func (n *OptNode) Compile() (Program, error) {
+	p, err := compile(n.s)
+	if err != nil {
+		return nil, err
+	}
 	var prog Program
 	prog = append(prog, iSplit{1, len(p) + 1})
 	prog = append(prog, p...)
-	return prog
+	return prog, nil
 }
 
 type LitNode struct {
@@ -139,6 +288,29 @@ func MustLit(s string) *LitNode {
 	}
 }
 
+// Keys returns a pattern matching the sequence of events described by 's' (see
+// ToEvents): a key name such as "enter" is a single LitNode, while "ZZ" is a
+// sequence of two.
+func Keys(s string) (Pattern, error) {
+	evs, err := ToEvents(s)
+	if err != nil {
+		return nil, err
+	}
+	lits := make([]Pattern, 0, len(evs))
+	for _, ev := range evs {
+		lits = append(lits, Lit(ev))
+	}
+	return Seq(lits...), nil
+}
+
+func MustKeys(s string) Pattern {
+	p, err := Keys(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
 func AnyRune() *LitNode {
 	return &LitNode{
 		ev: &WildcardRuneEvent{
@@ -165,17 +337,77 @@ func Set(s charset.Set) *LitNode {
 	}
 }
 
-func (n *LitNode) Compile() Program {
+func (n *LitNode) Compile() (Program, error) {
+	if n.ev == nil {
+		return nil, ErrNil
+	}
 	return Program{
 		iConsume{
 			match: n.ev,
 		},
+	}, nil
+}
+
+// A PredNode is a syntactic predicate: it looks ahead at the upcoming events
+// without consuming them and succeeds if 's' matches them (or, if 'neg' is
+// set, if 's' does not match them). Captures inside 's' are discarded.
+type PredNode struct {
+	s   Pattern
+	neg bool
+}
+
+// And succeeds if 's' matches the upcoming events, without consuming them.
+func And(s Pattern) *PredNode {
+	return &PredNode{
+		s: s,
+	}
+}
+
+// Not succeeds if 's' does not match the upcoming events, without consuming
+// them.
+func Not(s Pattern) *PredNode {
+	return &PredNode{
+		s:   s,
+		neg: true,
+	}
+}
+
+func (n *PredNode) Compile() (Program, error) {
+	p, err := compile(n.s)
+	if err != nil {
+		return nil, err
 	}
+	var prog Program
+	prog = append(prog, iPred{neg: n.neg, lbl: len(p) + 2})
+	prog = append(prog, p...)
+	prog = append(prog, iPredEnd{})
+	return prog, nil
 }
 
 type CapNode struct {
-	s   Pattern
-	cmd string
+	s    Pattern
+	cmd  string
+	pos  Pos
+	each []Pos
+}
+
+// A Pos is a position in a source file, such as a grammar.
+type Pos struct {
+	Name string // name of the file
+	Line int    // line number, starting at 1
+	Col  int    // column number in runes, starting at 1
+}
+
+// IsValid reports whether the position is known.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	if !p.IsValid() {
+		return p.Name
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Name, p.Line, p.Col)
 }
 
 func Cap(n Pattern, cmd string) *CapNode {
@@ -185,13 +417,128 @@ func Cap(n Pattern, cmd string) *CapNode {
 	}
 }
 
-func (c *CapNode) Compile() Program {
-	p := c.s.Compile()
+// At records the position of the capture's template in its source, which is
+// reported by Program.Captures.
+func (c *CapNode) At(pos Pos) *CapNode {
+	c.pos = pos
+	return c
+}
+
+// AtEach records the position of each byte of the capture's template in its
+// source, for a template that is not written as it is in the source, such as
+// a quoted literal with escapes. The position of the template is the position
+// of its first byte.
+func (c *CapNode) AtEach(pos []Pos) *CapNode {
+	c.each = pos
+	if len(pos) > 0 {
+		c.pos = pos[0]
+	}
+	return c
+}
+
+func (c *CapNode) Compile() (Program, error) {
+	p, err := compile(c.s)
+	if err != nil {
+		return nil, err
+	}
+	nargs := index(p)
 	var prog Program
 	prog = append(prog, iCapStart{})
 	prog = append(prog, p...)
-	prog = append(prog, iCapEnd{c.cmd})
-	return prog
+	prog = append(prog, iCapEnd{
+		cmd:   c.cmd,
+		names: names(p),
+		nargs: nargs,
+		pos:   c.pos,
+		each:  c.each,
+	})
+	return prog, nil
+}
+
+// index numbers the arguments of 'p' outside of nested captures and arguments
+// in the order of the pattern, and returns how many there are. An argument
+// keeps its number when an earlier one does not match.
+func index(p Program) int {
+	n := 0
+	depth := 0
+	for pc, in := range p {
+		switch t := in.(type) {
+		case iCapStart, iArgStart:
+			depth++
+		case iCapEnd:
+			depth--
+		case iArgEnd:
+			depth--
+			if depth == 0 {
+				n++
+				t.index = n
+				p[pc] = t
+			}
+		}
+	}
+	return n
+}
+
+// names returns the names of the arguments declared in 'p' outside of nested
+// captures. A declared name that did not match expands to nothing.
+func names(p Program) []string {
+	var names []string
+	depth := 0
+	for _, in := range p {
+		switch t := in.(type) {
+		case iCapStart:
+			depth++
+		case iCapEnd:
+			depth--
+		case iArgEnd:
+			if depth == 0 && t.name != "" {
+				names = append(names, t.name)
+			}
+		}
+	}
+	return names
+}
+
+// An ArgNode marks its sub-pattern as a positional argument of the enclosing
+// capture: the n-th ArgNode written inside a capture is bound to $n, or to an
+// empty value if it did not match. A named ArgNode is also bound to $name.
+// The ArgNodes of the rules called by the capture follow them in the order
+// they matched.
+type ArgNode struct {
+	s    Pattern
+	name string
+}
+
+// Arg makes the value of 's' a positional argument of the enclosing capture.
+// The value is the result of the last capture completed inside 's', or the
+// matched events if 's' does not complete any capture. A bracketed reference
+// such as <Num> in the grammar syntax compiles to Arg(NonTerm("Num")).
+func Arg(s Pattern) *ArgNode {
+	return &ArgNode{
+		s: s,
+	}
+}
+
+// Named is like Arg, but the value can also be referred to as $name in the
+// template of the enclosing capture. The grammar syntax $name:p compiles to
+// Named("name", p).
+func Named(name string, s Pattern) *ArgNode {
+	return &ArgNode{
+		s:    s,
+		name: name,
+	}
+}
+
+func (n *ArgNode) Compile() (Program, error) {
+	p, err := compile(n.s)
+	if err != nil {
+		return nil, err
+	}
+	var prog Program
+	prog = append(prog, iArgStart{})
+	prog = append(prog, p...)
+	prog = append(prog, iArgEnd{name: n.name})
+	return prog, nil
 }
 
 type EndNode struct{}
@@ -200,10 +547,10 @@ func End() *EndNode {
 	return &EndNode{}
 }
 
-func (n *EndNode) Compile() Program {
+func (n *EndNode) Compile() (Program, error) {
 	return Program{
 		iEnd{},
-	}
+	}, nil
 }
 
 type NonTermNode struct {
@@ -216,25 +563,147 @@ func NonTerm(name string) Pattern {
 	}
 }
 
-func (n *NonTermNode) Compile() Program {
+func (n *NonTermNode) Compile() (Program, error) {
 	var prog Program
 	prog = append(prog, iOpenCall{n.name})
-	return prog
+	return prog, nil
+}
+
+// A Rule is a named pattern of a grammar.
+type Rule struct {
+	Name    string
+	Pattern Pattern
 }
 
 type GrammarNode struct {
-	fns  map[string]Pattern
-	root string
+	rules []Rule
+	root  string
 }
 
+// Grammar returns a grammar made of the given rules. The rules are laid out
+// in alphabetical order; use Rules to choose the order.
 func Grammar(root string, fns map[string]Pattern) Pattern {
+	rules := make([]Rule, 0, len(fns))
+	for name, fn := range fns {
+		rules = append(rules, Rule{
+			Name:    name,
+			Pattern: fn,
+		})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Name < rules[j].Name
+	})
+	return Rules(root, rules...)
+}
+
+// Rules returns a grammar made of the given rules, which are laid out in the
+// program in the order they are given.
+func Rules(root string, rules ...Rule) Pattern {
 	return &GrammarNode{
-		fns:  fns,
-		root: root,
+		rules: rules,
+		root:  root,
 	}
 }
 
-func (n *GrammarNode) Compile() Program {
+// An UndefinedError is the error for a grammar that references rules that it
+// does not define.
+type UndefinedError struct {
+	Names []string
+}
+
+func (e *UndefinedError) Error() string {
+	return "undefined rules: " + strings.Join(e.Names, ", ")
+}
+
+// Check returns the sorted names of the rules that are referenced by the
+// grammar but not defined, and of the rules that are defined but can never be
+// reached from the root. The rules that a rule refers to are only known once
+// it compiles, so Check returns a *RuleError instead if a rule fails to
+// compile.
+func (n *GrammarNode) Check() (undefined, unreachable []string, err error) {
+	progs, err := n.compileRules()
+	if err != nil {
+		return nil, nil, err
+	}
+	undefined, unreachable = check(n.root, progs)
+	return undefined, unreachable, nil
+}
+
+// compileRules compiles every rule of the grammar. A rule that fails to
+// compile is given an empty program and the first error is returned.
+func (n *GrammarNode) compileRules() (map[string]Program, error) {
+	var first error
+	progs := make(map[string]Program, len(n.rules))
+	for _, r := range n.rules {
+		prog, err := compile(r.Pattern)
+		if _, ok := progs[r.Name]; ok {
+			err = ErrDuplicate
+		}
+		if err != nil && first == nil {
+			first = &RuleError{
+				Rule: r.Name,
+				Err:  err,
+			}
+		}
+		progs[r.Name] = prog
+	}
+	return progs, first
+}
+
+func check(root string, progs map[string]Program) (undefined, unreachable []string) {
+	reached := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if reached[name] {
+			return
+		}
+		reached[name] = true
+		for _, insn := range progs[name] {
+			if t, ok := insn.(iOpenCall); ok {
+				visit(t.name)
+			}
+		}
+	}
+	visit(root)
+
+	missing := make(map[string]bool)
+	if _, ok := progs[root]; !ok {
+		missing[root] = true
+	}
+	for name, prog := range progs {
+		if !reached[name] {
+			unreachable = append(unreachable, name)
+		}
+		for _, insn := range prog {
+			if t, ok := insn.(iOpenCall); ok {
+				if _, ok := progs[t.name]; !ok {
+					missing[t.name] = true
+				}
+			}
+		}
+	}
+	for name := range missing {
+		undefined = append(undefined, name)
+	}
+	sort.Strings(undefined)
+	sort.Strings(unreachable)
+	return undefined, unreachable
+}
+
+// Compile lays out the rules of the grammar and resolves the calls between
+// them. It returns a *RuleError if a rule fails to compile and an
+// *UndefinedError if a rule is not defined.
+func (n *GrammarNode) Compile() (Program, error) {
+	progs, err := n.compileRules()
+	if err != nil {
+		return nil, err
+	}
+	if undefined, _ := check(n.root, progs); len(undefined) > 0 {
+		return nil, &UndefinedError{
+			Names: undefined,
+		}
+	}
+
 	var prog Program
 	prog = append(prog, iOpenCall{n.root})
 	prog = append(prog, iEnd{})
@@ -242,9 +711,9 @@ func (n *GrammarNode) Compile() Program {
 	fnlocs := make(map[string]int)
 
 	i := len(prog)
-	for name, fn := range n.fns {
-		fnlocs[name] = i
-		fnprog := fn.Compile()
+	for _, r := range n.rules {
+		fnprog := progs[r.Name]
+		fnlocs[r.Name] = i
 		prog = append(prog, fnprog...)
 		prog = append(prog, iRet{})
 		i += 1 + len(fnprog)
@@ -257,5 +726,5 @@ func (n *GrammarNode) Compile() Program {
 		}
 	}
 
-	return prog
+	return prog, nil
 }
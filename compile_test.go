@@ -0,0 +1,88 @@
+package kbd
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestGrammarCheck(t *testing.T) {
+	g := Grammar("top", map[string]Pattern{
+		"top":    Alt(NonTerm("a"), NonTerm("b")),
+		"a":      Seq(MustLit("a"), NonTerm("c")),
+		"b":      MustLit("b"),
+		"unused": NonTerm("missing"),
+	}).(*GrammarNode)
+
+	undefined, unreachable, err := g.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(undefined, []string{"c", "missing"}) {
+		t.Errorf("undefined: got %v", undefined)
+	}
+	if !reflect.DeepEqual(unreachable, []string{"unused"}) {
+		t.Errorf("unreachable: got %v", unreachable)
+	}
+
+	_, err = g.Compile()
+	var uerr *UndefinedError
+	if !errors.As(err, &uerr) || !reflect.DeepEqual(uerr.Names, []string{"c", "missing"}) {
+		t.Fatalf("expected an undefined rule error, got %v", err)
+	}
+}
+
+func TestGrammarCheckError(t *testing.T) {
+	// "b" is only reached through "a", which does not compile
+	g := Grammar("top", map[string]Pattern{
+		"top": NonTerm("a"),
+		"a":   Seq(NonTerm("b"), Alt()),
+		"b":   MustLit("b"),
+	}).(*GrammarNode)
+
+	undefined, unreachable, err := g.Check()
+	var rerr *RuleError
+	if !errors.As(err, &rerr) || rerr.Rule != "a" {
+		t.Fatalf("expected an error for rule a, got %v", err)
+	}
+	if undefined != nil || unreachable != nil {
+		t.Fatalf("got undefined %v and unreachable %v with an error", undefined, unreachable)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		p      Pattern
+		expect error
+	}{
+		{"empty alt", Alt(), ErrEmpty},
+		{"empty choice", Choice(), ErrEmpty},
+		{"empty seq", Seq(MustLit("a"), Seq()), ErrEmpty},
+		{"nil", Cap(Star(nil), "x"), ErrNil},
+		{"nil event", Lit(nil), ErrNil},
+		{"rule", Grammar("top", map[string]Pattern{"top": Opt(Alt())}), ErrEmpty},
+		{"duplicate", Rules("top", Rule{"top", MustLit("a")}, Rule{"top", MustLit("b")}), ErrDuplicate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.p)
+			if !errors.Is(err, tt.expect) {
+				t.Fatalf("got %v, expected %v", err, tt.expect)
+			}
+		})
+	}
+
+	_, err := Compile(Seq(MustLit("a"), NonTerm("x")))
+	var uerr *UndefinedError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected an undefined rule error, got %v", err)
+	}
+
+	_, err = Compile(Grammar("top", map[string]Pattern{"top": Opt(nil)}))
+	var rerr *RuleError
+	if !errors.As(err, &rerr) || rerr.Rule != "top" {
+		t.Fatalf("expected an error for rule top, got %v", err)
+	}
+}
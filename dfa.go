@@ -0,0 +1,641 @@
+package kbd
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/micro-editor/tcell/v2"
+)
+
+var (
+	// ErrPredicate is the error for a program that cannot run as a DFA
+	// because it uses predicates (see And and Not).
+	ErrPredicate = errors.New("program uses predicates")
+	// ErrRecursive is the error for a program that cannot run as a DFA
+	// because a rule calls itself.
+	ErrRecursive = errors.New("grammar is recursive")
+)
+
+// An Executor runs a program over a stream of events. It is implemented by VM
+// and DFA, which return the same results for the same events.
+type Executor interface {
+	Exec(next tcell.Event) (action Action, ok bool, more bool)
+	Next() (Action, bool)
+	Discarded() []tcell.Event
+	Reset()
+}
+
+// DefaultMaxStates is the default limit on the number of states that a DFA
+// caches before starting over.
+const DefaultMaxStates = 4096
+
+// A DFA runs a program without predicates or recursion by dispatching each
+// event with a single table lookup. Its states are built lazily: the first
+// time an event is seen in a state, the events of the current run are
+// replayed on a VM and the resulting state of the VM is cached. Positions in
+// the events are kept in registers rather than in the state, so that loops
+// come back to the same state. Events are grouped into classes of events that
+// every pattern of the program matches in the same way, so that a state has
+// one transition per class.
+//
+// Actions are cached along with the transitions. Their variables, such as $0,
+// are cached as positions in the events, and their values are taken from the
+// events of each run. Only actions with a tree (see SetTree) are recomputed by
+// replaying the events on the VM.
+//
+// Like a VM, a DFA must only be used by one goroutine at a time.
+type DFA struct {
+	vm    *VM
+	start *dstate
+	cur   *dstate
+	// states by signature
+	states map[string]*dstate
+	max    int
+
+	// events of the current run, which started at the last Reset or when
+	// the previous run ended
+	hist events
+	// positions in hist held by the registers of the current state, and
+	// space to compute the next ones
+	regs, spare []int
+	// events to be fed again to a fresh run, the next one last
+	refeed events
+	// actions that were completed but not returned yet
+	queue []Action
+	// events that did not belong to any match
+	discarded events
+
+	// distinct patterns of the program, which define the event classes
+	matchers []Event
+	// class of each set of matching patterns, and cached classes of events
+	classes map[string]int
+	keys    map[eventKey]int
+	// ids given to the return stacks of the VM in signatures, by return
+	// address and id of the parent stack, since the VM does not keep the
+	// same nodes across runs
+	calls map[[2]int]int
+}
+
+type dstate struct {
+	next map[int]*transition
+}
+
+// A transition records what the VM did when it received an event of some
+// class in a state. Positions in the events of the run are given as refs, so
+// that the same transition holds wherever the run started.
+type transition struct {
+	// the next state, or nil if the run ended
+	to *dstate
+	// the registers of the next state
+	regs []ref
+	// actions without their Vars, whose spans are refs
+	actions []Action
+	// the actions have trees and must be computed by the VM
+	replay bool
+	// whether the first event of the run was discarded
+	discard bool
+	// the events from this position are fed again to a fresh run, unless it
+	// is refNone
+	requeue ref
+}
+
+// A ref is a position in the events of the run, as seen by a transition: the
+// register of the state that the transition leaves if it is not negative, or
+// one of the positions below.
+type ref int
+
+const (
+	refNone   ref = -1 - iota
+	refStart      // the start of the run
+	refSecond     // after the first event of the run
+	refPrev       // before the event of the transition
+	refEnd        // after the event of the transition
+)
+
+// An eventKey identifies events that every pattern matches in the same way.
+type eventKey struct {
+	kind byte
+	key  tcell.Key
+	ch   rune
+	mod  tcell.ModMask
+	btn  tcell.ButtonMask
+}
+
+const (
+	keyEvent byte = iota
+	mouseEvent
+	pasteEvent
+	resizeEvent
+)
+
+// NewDFA returns a DFA running 'prog'. It returns ErrPredicate or ErrRecursive
+// if the program cannot run as a DFA.
+func NewDFA(prog Program) (*DFA, error) {
+	if err := regular(prog); err != nil {
+		return nil, err
+	}
+	d := &DFA{
+		vm:  NewVM(prog),
+		max: DefaultMaxStates,
+	}
+	d.vm.spans = true
+	seen := make(map[string]bool)
+	for _, insn := range prog {
+		if t, ok := insn.(iConsume); ok && !seen[t.match.String()] {
+			seen[t.match.String()] = true
+			d.matchers = append(d.matchers, t.match)
+		}
+	}
+	d.flush()
+	d.Reset()
+	return d, nil
+}
+
+// regular checks that the program has no predicates and no recursive calls.
+func regular(prog Program) error {
+	// rules start at the targets of calls and end before the next rule
+	var starts []int
+	for _, insn := range prog {
+		switch t := insn.(type) {
+		case iPred:
+			return ErrPredicate
+		case iCall:
+			starts = append(starts, t.lbl)
+		}
+	}
+	sort.Ints(starts)
+	rule := func(pc int) int {
+		return sort.Search(len(starts), func(i int) bool {
+			return starts[i] > pc
+		})
+	}
+
+	calls := make(map[int][]int)
+	for pc, insn := range prog {
+		if t, ok := insn.(iCall); ok {
+			from := rule(pc)
+			calls[from] = append(calls[from], rule(t.lbl))
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[int]int)
+	var visit func(r int) bool
+	visit = func(r int) bool {
+		switch marks[r] {
+		case visiting:
+			return false
+		case visited:
+			return true
+		}
+		marks[r] = visiting
+		for _, c := range calls[r] {
+			if !visit(c) {
+				return false
+			}
+		}
+		marks[r] = visited
+		return true
+	}
+	for r := range calls {
+		if !visit(r) {
+			return ErrRecursive
+		}
+	}
+	return nil
+}
+
+// SetPolicy sets how simultaneous matches are chosen, as for VM.SetPolicy.
+func (d *DFA) SetPolicy(policy Policy) {
+	d.vm.SetPolicy(policy)
+	d.flush()
+	d.Reset()
+}
+
+// SetQuoting sets the quoting of the actions, as for VM.SetQuoting.
+func (d *DFA) SetQuoting(quoting Quoting) {
+	d.vm.SetQuoting(quoting)
+	d.flush()
+	d.Reset()
+}
+
+// SetTree sets whether the actions include their tree, as for VM.SetTree.
+// Actions with a tree are always computed by replaying the events.
+func (d *DFA) SetTree(tree bool) {
+	d.vm.SetTree(tree)
+	d.flush()
+	d.Reset()
+}
+
+// SetMaxStates limits the number of cached states. When there are more, the
+// cache is emptied.
+func (d *DFA) SetMaxStates(max int) {
+	d.max = max
+}
+
+// flush empties the cache of states.
+func (d *DFA) flush() {
+	d.states = make(map[string]*dstate)
+	d.classes = make(map[string]int)
+	d.keys = make(map[eventKey]int)
+	d.calls = make(map[[2]int]int)
+	d.vm.Reset()
+	d.start, _ = d.state()
+}
+
+// Reset abandons the events seen so far.
+func (d *DFA) Reset() {
+	d.cur = d.start
+	d.hist = d.hist[:0]
+	d.regs = d.regs[:0]
+	d.refeed = d.refeed[:0]
+	d.queue = d.queue[:0]
+	d.discarded = nil
+}
+
+// Exec consumes the next event. It returns the same values as VM.Exec.
+func (d *DFA) Exec(next tcell.Event) (action Action, ok bool, more bool) {
+	more = d.run(next)
+	for n := len(d.refeed); n > 0; n = len(d.refeed) {
+		ev := d.refeed[n-1]
+		d.refeed[n-1] = nil
+		d.refeed = d.refeed[:n-1]
+		more = d.run(ev)
+	}
+	action, ok = d.Next()
+	return action, ok, more
+}
+
+// run follows the transition of the current state on one event, as VM.run
+// does, and returns whether the run goes on. The events that the transition
+// requeues are left in refeed.
+func (d *DFA) run(next tcell.Event) bool {
+	class := d.class(next)
+	t, cached := d.cur.next[class]
+	if !cached {
+		t = d.transition(next, class)
+	}
+	d.hist = append(d.hist, next)
+
+	if t.replay {
+		d.replay()
+	} else {
+		for _, action := range t.actions {
+			d.queue = append(d.queue, d.vars(action))
+		}
+	}
+	if t.discard {
+		d.discarded = append(d.discarded, d.hist[0])
+	}
+	if t.requeue != refNone {
+		for i := len(d.hist) - 1; i >= d.pos(t.requeue); i-- {
+			d.refeed = append(d.refeed, d.hist[i])
+		}
+	}
+	if t.to == nil {
+		// the next event starts a fresh run
+		d.cur = d.start
+		d.hist = d.hist[:0]
+		d.regs = d.regs[:0]
+		return false
+	}
+	d.spare = d.spare[:0]
+	for _, r := range t.regs {
+		d.spare = append(d.spare, d.pos(r))
+	}
+	d.regs, d.spare = d.spare, d.regs
+	d.cur = t.to
+	return true
+}
+
+// pos returns the position in the events of the run that r refers to, once
+// the event of the transition was added to them.
+func (d *DFA) pos(r ref) int {
+	switch r {
+	case refStart:
+		return 0
+	case refSecond:
+		return 1
+	case refPrev:
+		return len(d.hist) - 1
+	case refEnd:
+		return len(d.hist)
+	}
+	return d.regs[r]
+}
+
+// Next returns the next action completed by the last call to Exec, as for
+// VM.Next.
+func (d *DFA) Next() (Action, bool) {
+	if len(d.queue) == 0 {
+		return Action{}, false
+	}
+	action := d.queue[0]
+	copy(d.queue, d.queue[1:])
+	d.queue[len(d.queue)-1] = Action{}
+	d.queue = d.queue[:len(d.queue)-1]
+	return action, true
+}
+
+// Discarded returns the events that did not belong to any match, as for
+// VM.Discarded.
+func (d *DFA) Discarded() []tcell.Event {
+	evs := d.discarded
+	d.discarded = nil
+	return evs
+}
+
+// Pending returns the events that can come next, as for VM.Pending.
+func (d *DFA) Pending() []Hint {
+	d.load(d.hist)
+	return d.vm.Pending()
+}
+
+// load runs the VM on the events of a run, dropping the actions they
+// complete. The events never end the run, so nothing is discarded or
+// requeued.
+func (d *DFA) load(evs events) {
+	d.vm.Reset()
+	for _, ev := range evs {
+		d.vm.run(ev)
+		for _, ok := d.vm.Next(); ok; _, ok = d.vm.Next() {
+		}
+	}
+}
+
+// replay runs the VM on the events of the run and queues the actions of the
+// last event.
+func (d *DFA) replay() {
+	n := len(d.hist) - 1
+	d.load(d.hist[:n])
+	d.vm.run(d.hist[n])
+	for action, ok := d.vm.Next(); ok; action, ok = d.vm.Next() {
+		action.spans = nil
+		d.queue = append(d.queue, action)
+	}
+	// the discarded and requeued events are taken from the transition
+	d.vm.Discarded()
+	d.vm.refeed = d.vm.refeed[:0]
+}
+
+// vars returns a cached action with the values of its variables in the
+// events of the run.
+func (d *DFA) vars(action Action) Action {
+	if len(action.spans) == 0 {
+		return action
+	}
+	action.Vars = make([]interface{}, len(action.spans))
+	for i, s := range action.spans {
+		action.Vars[i] = d.hist.value(d.pos(ref(s.start)), d.pos(ref(s.end)))
+	}
+	action.spans = nil
+	return action
+}
+
+// transition computes the transition from the current state on an event of
+// the given class, which is not cached yet.
+func (d *DFA) transition(next tcell.Event, class int) *transition {
+	if len(d.states) >= d.max {
+		// start over, keeping the current state
+		cur := d.cur
+		d.flush()
+		cur.next = make(map[int]*transition)
+		d.cur = cur
+		class = d.class(next)
+	}
+
+	d.load(d.hist)
+	_, regs := d.signature()
+	// the positions of the run as refs, the event being at n-1
+	n := len(d.hist) + 1
+	at := func(p int) ref {
+		switch p {
+		case n:
+			return refEnd
+		case n - 1:
+			return refPrev
+		case 0:
+			return refStart
+		}
+		for i, r := range regs {
+			if r == p {
+				return ref(i)
+			}
+		}
+		// every position of the VM comes from the state or from the event
+		panic("kbd: position not in the state")
+	}
+
+	t := &transition{
+		requeue: refNone,
+	}
+	d.vm.run(next)
+	for action, ok := d.vm.Next(); ok; action, ok = d.vm.Next() {
+		if action.Tree != nil {
+			t.replay = true
+		}
+		// the values of the variables are found again in the events of each
+		// run
+		action.Vars = nil
+		for i, s := range action.spans {
+			action.spans[i] = span{
+				start: int(at(s.start)),
+				end:   int(at(s.end)),
+			}
+		}
+		t.actions = append(t.actions, action)
+	}
+	t.discard = len(d.vm.Discarded()) > 0
+	if k := len(d.vm.refeed); k > 0 {
+		// the VM only discards the first event, and then requeues the others
+		if t.discard {
+			t.requeue = refSecond
+		} else {
+			t.requeue = at(n - k)
+		}
+		d.vm.refeed = d.vm.refeed[:0]
+	}
+	if t.replay {
+		t.actions = nil
+	}
+	if d.vm.pending() {
+		var next []int
+		t.to, next = d.state()
+		for _, p := range next {
+			t.regs = append(t.regs, at(p))
+		}
+	}
+	d.cur.next[class] = t
+	return t
+}
+
+// state returns the cached state for the current state of the VM, and the
+// positions held by its registers.
+func (d *DFA) state() (*dstate, []int) {
+	sig, regs := d.signature()
+	s, ok := d.states[sig]
+	if !ok {
+		s = &dstate{
+			next: make(map[int]*transition),
+		}
+		d.states[sig] = s
+	}
+	return s, regs
+}
+
+// signature describes everything in the state of the VM that decides what it
+// does with the next events. The captures in progress are included since they
+// decide the actions, but their variables are described by their positions
+// rather than by their values. A position is described as the end or the
+// start of the events of the run, or else as a register, numbered in order of
+// appearance: the positions held by the registers are returned, so that loops
+// come back to the same state however many events they consumed.
+func (d *DFA) signature() (string, []int) {
+	vm := d.vm
+	var regs []int
+	pos := func(buf []byte, p int) []byte {
+		switch p {
+		case len(vm.evs):
+			return append(buf, 'n')
+		case 0:
+			return append(buf, 'z')
+		}
+		i := 0
+		for i < len(regs) && regs[i] != p {
+			i++
+		}
+		if i == len(regs) {
+			regs = append(regs, p)
+		}
+		return strconv.AppendInt(append(buf, 'r'), int64(i), 10)
+	}
+
+	var buf []byte
+	if len(vm.evs) == 0 {
+		// the start of the run is also the position before the next event
+		buf = append(buf, '^')
+	}
+	for i, m := range vm.machines {
+		if i > 0 {
+			buf = append(buf, '|')
+		}
+		// the machines are in priority order, and the prioritized choices
+		// between them also hold between the machines they fork
+		for _, o := range vm.machines[:i] {
+			switch {
+			case o.preferred(m):
+				buf = append(buf, '<')
+			case m.preferred(o):
+				buf = append(buf, '>')
+			default:
+				buf = append(buf, '=')
+			}
+		}
+		if m.status.done {
+			buf = append(buf, 'd')
+		}
+		buf = strconv.AppendInt(buf, int64(m.pc), 10)
+		buf = append(buf, ' ')
+		buf = pos(buf, m.sp)
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, int64(d.call(m.rets)), 10)
+		for _, v := range m.vals {
+			buf = append(buf, ' ')
+			buf = strconv.AppendQuote(buf, v.s)
+			if v.arg {
+				buf = append(buf, 'a')
+				buf = strconv.AppendInt(buf, int64(v.index), 10)
+				buf = strconv.AppendQuote(buf, v.name)
+			}
+		}
+		for _, f := range m.caps {
+			buf = append(buf, " f"...)
+			buf = pos(buf, f.sp)
+			buf = append(buf, ' ')
+			buf = strconv.AppendInt(buf, int64(f.nvals), 10)
+			buf = append(buf, ' ')
+			buf = strconv.AppendInt(buf, int64(f.pc), 10)
+		}
+		for _, s := range m.vars {
+			buf = append(buf, " s"...)
+			buf = pos(buf, s.start)
+			buf = append(buf, ' ')
+			buf = pos(buf, s.end)
+		}
+	}
+	// the events after the last match are fed again if every machine fails
+	buf = append(buf, ';')
+	buf = pos(buf, vm.matched)
+	return string(buf), regs
+}
+
+// call returns an id for the return stack c.
+func (d *DFA) call(c *call) int {
+	if c == nil {
+		return 0
+	}
+	k := [2]int{c.ret, d.call(c.parent)}
+	id, ok := d.calls[k]
+	if !ok {
+		id = len(d.calls) + 1
+		d.calls[k] = id
+	}
+	return id
+}
+
+// class returns the class of an event: events of the same class are matched
+// by the same patterns of the program.
+func (d *DFA) class(ev tcell.Event) int {
+	var k eventKey
+	switch ev := ev.(type) {
+	case *tcell.EventKey:
+		k = eventKey{
+			kind: keyEvent,
+			key:  ev.Key(),
+			ch:   ev.Rune(),
+			mod:  ev.Modifiers(),
+		}
+	case *tcell.EventMouse:
+		k = eventKey{
+			kind: mouseEvent,
+			mod:  ev.Modifiers(),
+			btn:  ev.Buttons(),
+		}
+	case *tcell.EventPaste:
+		k = eventKey{
+			kind: pasteEvent,
+		}
+	case *tcell.EventResize:
+		k = eventKey{
+			kind: resizeEvent,
+		}
+	default:
+		return d.classify(ev)
+	}
+	c, ok := d.keys[k]
+	if !ok {
+		c = d.classify(ev)
+		d.keys[k] = c
+	}
+	return c
+}
+
+// classify computes the class of an event from the patterns that match it.
+func (d *DFA) classify(ev tcell.Event) int {
+	set := make([]byte, (len(d.matchers)+7)/8)
+	for i, m := range d.matchers {
+		if m.Match(ev) {
+			set[i/8] |= 1 << (i % 8)
+		}
+	}
+	c, ok := d.classes[string(set)]
+	if !ok {
+		c = len(d.classes)
+		d.classes[string(set)] = c
+	}
+	return c
+}
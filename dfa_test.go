@@ -0,0 +1,182 @@
+package kbd
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/micro-editor/tcell/v2"
+)
+
+// result is what an Executor returns for one event.
+type result struct {
+	Cmds      []string
+	More      bool
+	Discarded string
+}
+
+func results(ex Executor, evs []tcell.Event) []result {
+	var res []result
+	for _, ev := range evs {
+		var r result
+		action, ok, more := ex.Exec(ev)
+		for ok {
+			r.Cmds = append(r.Cmds, expandVars(action))
+			action, ok = ex.Next()
+		}
+		r.More = more
+		for _, ev := range ex.Discarded() {
+			r.Discarded += ev2str(ev)
+		}
+		res = append(res, r)
+		if !more {
+			ex.Reset()
+		}
+	}
+	return res
+}
+
+func TestDFA(t *testing.T) {
+	move := Rules("top",
+		Rule{"top", Alt(
+			Cap(Seq(MustKeys("d"), Arg(NonTerm("move"))), "delete $1"),
+			Cap(MustKeys("dd"), "delete-line"),
+			Cap(Seq(Plus(RangeRune('0', '9')), MustKeys("G")), "goto $0"),
+			Cap(MustKeys("x"), "delete-char"),
+			Choice(Cap(MustKeys("gg"), "top"), Cap(MustKeys("g"), "go")),
+		)},
+		Rule{"move", Alt(Cap(MustKeys("w"), "word"), Cap(MustKeys("e"), "end"))},
+	)
+	patterns := map[string]Pattern{
+		"flat": flat(),
+		"move": Seq(move, End()),
+		"star": Seq(Cap(Seq(Star(AnyRune()), MustKeys("x")), "$0"), End()),
+		// the inner captures take the same transitions but give different
+		// actions
+		// the digits are requeued when "1x" fails after them
+		"count": Seq(Alt(
+			Cap(Seq(Plus(RangeRune('0', '9')), MustKeys("G")), "goto $0"),
+			Cap(MustKeys("1x"), "x $0"),
+		), End()),
+		"inner": Seq(Cap(Seq(Alt(Cap(MustKeys("d"), "cut"), Cap(MustKeys("x"), "del")), MustKeys("g")), "$1 done"), End()),
+	}
+	alphabet := []rune("dwexg12G ")
+
+	rnd := rand.New(rand.NewSource(1))
+	for name, p := range patterns {
+		for _, policy := range []Policy{FirstMatch, LongestMatch} {
+			prog := MustCompile(p)
+			vm := NewVM(prog)
+			vm.SetPolicy(policy)
+			d, err := NewDFA(prog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.SetPolicy(policy)
+
+			for i := 0; i < 200; i++ {
+				input := make([]rune, 1+rnd.Intn(8))
+				for j := range input {
+					input[j] = alphabet[rnd.Intn(len(alphabet))]
+				}
+				evs := keys(string(input))
+				vm.Reset()
+				d.Reset()
+				expect := results(vm, evs)
+				got := results(d, evs)
+				if !reflect.DeepEqual(got, expect) {
+					t.Fatalf("%s (policy %d) on %q:\ngot      %+v\nexpected %+v", name, policy, string(input), got, expect)
+				}
+			}
+		}
+	}
+}
+
+func TestDFAVars(t *testing.T) {
+	d, err := NewDFA(MustCompile(Seq(Cap(AnyRune(), "insert $0"), End())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, ev := range keys("abcab") {
+		action, ok, _ := d.Exec(ev)
+		if !ok {
+			t.Fatalf("no action for %s", ev2str(ev))
+		}
+		got = append(got, action.Vars...)
+		d.Reset()
+	}
+	expect := []interface{}{'a', 'b', 'c', 'a', 'b'}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("got %v, expected %v", got, expect)
+	}
+	for _, tr := range d.start.next {
+		if tr.replay {
+			t.Fatal("actions with variables are not cached")
+		}
+	}
+}
+
+func TestDFAStates(t *testing.T) {
+	d, err := NewDFA(MustCompile(Seq(Cap(Seq(Plus(RangeRune('0', '9')), MustKeys("G")), "goto $0"), End())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := strings.Repeat("1", 1000) + "G"
+	var action Action
+	for _, ev := range keys(input) {
+		action, _, _ = d.Exec(ev)
+	}
+	if evs, ok := action.Vars[0].(Events); !ok || len(evs) != len(input) {
+		t.Fatalf("got %v, expected the %d events", action.Vars, len(input))
+	}
+	if len(d.states) > 5 {
+		t.Fatalf("got %d states, expected the loop to reuse them", len(d.states))
+	}
+}
+
+func TestDFAErrors(t *testing.T) {
+	_, err := NewDFA(MustCompile(Seq(Not(MustKeys("a")), AnyRune())))
+	if !errors.Is(err, ErrPredicate) {
+		t.Fatalf("got %v, expected %v", err, ErrPredicate)
+	}
+
+	rec := Grammar("top", map[string]Pattern{
+		"top":  Alt(Cap(MustKeys("x"), "x"), NonTerm("nest")),
+		"nest": Seq(MustKeys("("), NonTerm("top"), MustKeys(")")),
+	})
+	_, err = NewDFA(MustCompile(rec))
+	if !errors.Is(err, ErrRecursive) {
+		t.Fatalf("got %v, expected %v", err, ErrRecursive)
+	}
+}
+
+func TestDFAAllocs(t *testing.T) {
+	d, err := NewDFA(MustCompile(flat()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	evs := keys("hello world")
+	run(d, evs)
+	allocs := testing.AllocsPerRun(100, func() {
+		run(d, evs)
+	})
+	if allocs != 0 {
+		t.Fatalf("got %v allocations, expected none", allocs)
+	}
+}
+
+func BenchmarkDFAKeyRepeat(b *testing.B) {
+	d, err := NewDFA(MustCompile(flat()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	evs := keys("j")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		run(d, evs)
+	}
+}
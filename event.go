@@ -1,8 +1,10 @@
 package kbd
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/zyedidia/gpeg/charset"
 	"github.com/zyedidia/kbd/cbind"
@@ -11,7 +13,9 @@ import (
 )
 
 // An Event is a blueprint for an actual tcell event and given a tcell event
-// specifies if it matches.
+// specifies if it matches. Match must not modify the Event, since a program
+// may be run by several goroutines at once; the matched events are recorded
+// by the machines instead.
 type Event interface {
 	Match(ev tcell.Event) bool
 	String() string
@@ -43,23 +47,15 @@ func (ke *KeyEvent) String() string {
 	return s
 }
 
-// A MouseEvent matches a combination of mouse button and modifiers. It also
-// stores the resulting position of the mouse event after the event has been
-// matched.
+// A MouseEvent matches a combination of mouse button and modifiers.
 type MouseEvent struct {
 	btn tcell.ButtonMask
 	mod tcell.ModMask
-
-	// result
-	X, Y int
 }
 
 func (me *MouseEvent) Match(ev tcell.Event) bool {
 	if mev, ok := ev.(*tcell.EventMouse); ok {
-		if mev.Buttons() == me.btn && mev.Modifiers() == me.mod {
-			me.X, me.Y = mev.Position()
-			return true
-		}
+		return mev.Buttons() == me.btn && mev.Modifiers() == me.mod
 	}
 	return false
 }
@@ -72,42 +68,32 @@ func (me *MouseEvent) String() string {
 	return s
 }
 
-// A WildcardRuneEvent matches any rune event in the given range and stores the
-// matching event.
+// A WildcardRuneEvent matches any rune event in the given range.
 type WildcardRuneEvent struct {
 	Low, High rune
-	// result
-	Rune rune
 }
 
 func (we *WildcardRuneEvent) Match(ev tcell.Event) bool {
 	if kev, ok := ev.(*tcell.EventKey); ok && kev.Key() == tcell.KeyRune && kev.Modifiers() == tcell.ModNone {
 		r := kev.Rune()
-		if r >= we.Low && r <= we.High {
-			we.Rune = kev.Rune()
-			return true
-		}
+		return r >= we.Low && r <= we.High
 	}
 	return false
 }
 
 func (we *WildcardRuneEvent) String() string {
-	return fmt.Sprintf("Any [%s-%s]", string(we.Low), string(we.High))
+	return fmt.Sprintf("Any [U+%04X-U+%04X]", we.Low, we.High)
 }
 
+// A WildcardRuneSetEvent matches any rune event in the given set.
 type WildcardRuneSetEvent struct {
 	Set charset.Set
-	// result
-	Rune rune
 }
 
 func (we *WildcardRuneSetEvent) Match(ev tcell.Event) bool {
 	if kev, ok := ev.(*tcell.EventKey); ok && kev.Key() == tcell.KeyRune && kev.Modifiers() == tcell.ModNone {
 		r := kev.Rune()
-		if r >= 0 && r < 256 && we.Set.Has(byte(r)) {
-			we.Rune = kev.Rune()
-			return true
-		}
+		return r >= 0 && r < 256 && we.Set.Has(byte(r))
 	}
 	return false
 }
@@ -116,36 +102,24 @@ func (we *WildcardRuneSetEvent) String() string {
 	return fmt.Sprintf("AnySet %v", we.Set)
 }
 
-// A PasteEvent matches any tcell paste event and stores the pasted text.
-type PasteEvent struct {
-	// result
-	Text string
-}
+// A PasteEvent matches any tcell paste event.
+type PasteEvent struct{}
 
 func (pe *PasteEvent) Match(ev tcell.Event) bool {
-	if pev, ok := ev.(*tcell.EventPaste); ok {
-		pe.Text = pev.Text()
-		return true
-	}
-	return false
+	_, ok := ev.(*tcell.EventPaste)
+	return ok
 }
 
 func (pe *PasteEvent) String() string {
 	return "Paste"
 }
 
-// A ResizeEvent matches any resize event and stores the new screen dimensions.
-type ResizeEvent struct {
-	// result
-	W, H int
-}
+// A ResizeEvent matches any resize event.
+type ResizeEvent struct{}
 
 func (re *ResizeEvent) Match(ev tcell.Event) bool {
-	if rev, ok := ev.(*tcell.EventResize); ok {
-		re.W, re.H = rev.Size()
-		return true
-	}
-	return false
+	_, ok := ev.(*tcell.EventResize)
+	return ok
 }
 
 func (re *ResizeEvent) String() string {
@@ -184,3 +158,63 @@ func ToEvent(s string) (Event, error) {
 		}, nil
 	}
 }
+
+// ToEvents constructs a sequence of events from a string. If the whole string
+// names a single event (a single rune, a key name such as "enter", or a
+// combination such as "ctrl+s") the result is that one event. A string that
+// starts with a modifier, such as "ctrl-c", must be a key combination, and it
+// is an error if it is not one. Any other string is split into keys using the
+// key notation of cbind.Tokenize: each rune is a separate key event, so "ZZ"
+// is two events, and tokens such as <esc> or <C-x> stand for a single key, so
+// "d<esc>" is two events as well.
+func ToEvents(s string) ([]Event, error) {
+	if len(s) == 0 {
+		return nil, errors.New("empty key sequence")
+	}
+	if ev, err := ToEvent(s); err == nil {
+		return []Event{ev}, nil
+	} else if utf8.RuneCountInString(s) == 1 {
+		return nil, err
+	} else if chord(s) {
+		toks, err := cbind.Tokenize("<" + s + ">")
+		if err != nil || len(toks) != 1 {
+			return nil, fmt.Errorf("unknown key name %q", s)
+		}
+		ev, err := ToEvent(toks[0].Key)
+		if err != nil {
+			return nil, fmt.Errorf("unknown key name %q", s)
+		}
+		return []Event{ev}, nil
+	}
+
+	toks, err := cbind.Tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	evs := make([]Event, 0, len(toks))
+	for _, tok := range toks {
+		ev, err := ToEvent(tok.Key)
+		if err != nil {
+			return nil, &cbind.NotationError{
+				Token:  s[tok.Offset : tok.Offset+tok.Len],
+				Offset: tok.Offset,
+				Err:    err,
+			}
+		}
+		evs = append(evs, ev)
+	}
+	return evs, nil
+}
+
+// chord returns true if 's' starts with a modifier, as in "ctrl-c" or "alt+x".
+func chord(s string) bool {
+	i := strings.IndexAny(s, "+-")
+	if i <= 0 || i == len(s)-1 {
+		return false
+	}
+	switch strings.ToLower(s[:i]) {
+	case cbind.LabelCtrl, cbind.LabelAlt, cbind.LabelMeta, cbind.LabelShift:
+		return true
+	}
+	return false
+}
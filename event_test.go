@@ -0,0 +1,52 @@
+package kbd
+
+import "testing"
+
+func TestToEvents(t *testing.T) {
+	tests := []struct {
+		s      string
+		expect []string
+	}{
+		{"a", []string{"a"}},
+		{"ZZ", []string{"Z", "Z"}},
+		{"gg", []string{"g", "g"}},
+		{"enter", []string{"Enter"}},
+		{"ctrl+s", []string{"Ctrl+S"}},
+		{"i'", []string{"i", "'"}},
+		{"é", []string{"é"}},
+		{"<esc>", []string{"Escape"}},
+		{"d<esc>", []string{"d", "Escape"}},
+		{"<ctrl-c>", []string{"Ctrl+C"}},
+		{"<ctrl+w>", []string{"Ctrl+W"}},
+		{"<backspace>", []string{"Backspace"}},
+		{"ctrl-c", []string{"Ctrl+C"}},
+		{"alt-x", []string{"Alt+x"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			evs, err := ToEvents(tt.s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(evs) != len(tt.expect) {
+				t.Fatalf("got %d events, expected %d", len(evs), len(tt.expect))
+			}
+			for i, ev := range evs {
+				if ev.String() != tt.expect[i] {
+					t.Fatalf("event %d: got %s, expected %s", i, ev, tt.expect[i])
+				}
+			}
+		})
+	}
+
+	if _, err := ToEvents(""); err == nil {
+		t.Fatal("expected error for empty key sequence")
+	}
+	if _, err := ToEvents("d<foo>"); err == nil || err.Error() != "<foo> at offset 1: invalid key event" {
+		t.Fatalf("expected error for <foo>, got %v", err)
+	}
+	if _, err := ToEvents("ctrl-foo"); err == nil || err.Error() != `unknown key name "ctrl-foo"` {
+		t.Fatalf("expected error for ctrl-foo, got %v", err)
+	}
+}
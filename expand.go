@@ -2,6 +2,7 @@ package kbd
 
 import (
 	"bytes"
+	"fmt"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -23,7 +24,7 @@ func nargs(template string) (n int, zero bool) {
 			template = template[2:]
 			continue
 		}
-		num, rest, ok := extract(template)
+		_, num, rest, ok := extract(template)
 		if !ok {
 			// Malformed; treat $ as raw text.
 			template = template[1:]
@@ -48,8 +49,14 @@ func max(a, b int) int {
 }
 
 // Expands all occurrences of $x, where x is a number, with the corresponding
-// entry from args. Use $$ to escape a dollar sign.
-func expand(template string, args []string) string {
+// entry from args, and of $name with the value returned by lookup. Names that
+// lookup does not know and $$ are kept, so that the result can be expanded
+// again by an enclosing capture and by Action.Expand without taking a dollar
+// sign for a variable. The Cmd of an action is the result after unescape.
+func expand(template string, args []string, lookup func(name string) (string, bool)) string {
+	if strings.IndexByte(template, '$') < 0 {
+		return template
+	}
 	buf := &bytes.Buffer{}
 	for len(template) > 0 {
 		i := strings.Index(template, "$")
@@ -59,31 +66,43 @@ func expand(template string, args []string) string {
 		buf.WriteString(template[:i])
 		template = template[i:]
 		if len(template) > 1 && template[1] == '$' {
-			// Treat $$ as $.
-			buf.WriteByte('$')
+			buf.WriteString("$$")
 			template = template[2:]
 			continue
 		}
-		num, rest, ok := extract(template)
+		name, num, rest, ok := extract(template)
 		if !ok {
 			// Malformed; treat $ as raw text.
 			buf.WriteByte('$')
 			template = template[1:]
 			continue
 		}
-		template = rest
-		if num >= 0 {
-			if num < len(args) {
-				buf.WriteString(args[num])
+		if num < 0 {
+			if val, ok := lookup(name); ok {
+				buf.WriteString(val)
+			} else {
+				buf.WriteString(template[:len(template)-len(rest)])
 			}
+		} else if num < len(args) {
+			buf.WriteString(args[num])
 		}
+		template = rest
 	}
 	buf.WriteString(template)
 	return buf.String()
 }
 
-// looks for $x numbers and extracts the number.
-func extract(str string) (num int, rest string, ok bool) {
+// unescape replaces $$ by $.
+func unescape(s string) string {
+	if !strings.Contains(s, "$$") {
+		return s
+	}
+	return strings.ReplaceAll(s, "$$", "$")
+}
+
+// looks for $x numbers or $name names and extracts them. The number is -1 for
+// a name.
+func extract(str string) (name string, num int, rest string, ok bool) {
 	if len(str) < 2 || str[0] != '$' {
 		return
 	}
@@ -100,7 +119,7 @@ func extract(str string) (num int, rest string, ok bool) {
 		// empty name is not okay
 		return
 	}
-	name := str[:i]
+	name = str[:i]
 
 	// Parse number.
 	num = 0
@@ -117,6 +136,113 @@ func extract(str string) (num int, rest string, ok bool) {
 	}
 
 	rest = str[i:]
-	ok = num != -1
+	// a name must not start with a digit
+	first, _ := utf8.DecodeRuneInString(name)
+	ok = num != -1 || unicode.IsLetter(first) || first == '_'
 	return
 }
+
+// A Resolver provides the values of the variables of the host, such as $pos,
+// when an action is expanded.
+type Resolver interface {
+	// Resolve returns the value of the variable with the given name, or false
+	// if there is no such variable.
+	Resolve(name string) (string, bool)
+}
+
+// ResolverFunc adapts a function to a Resolver.
+type ResolverFunc func(name string) (string, bool)
+
+func (f ResolverFunc) Resolve(name string) (string, bool) {
+	return f(name)
+}
+
+// A VarError is the error for a variable of an action that is neither one of
+// its Vars nor known to the Resolver.
+type VarError struct {
+	Name string
+}
+
+func (e *VarError) Error() string {
+	return "unknown variable $" + e.Name
+}
+
+// Expand returns the command of the action with its variables replaced by
+// their values. $0, $1, ... are replaced by the corresponding entry of Vars,
+// quoted with the action's Quoting so that each is a single word of the
+// command. Other names are looked up with 'r', which may be nil, and their
+// values are used as they are. It returns a *VarError for a name that 'r' does
+// not know. A name declared by a capture (see Named) is not an error when it
+// did not match: like a positional argument that did not match, it was
+// already expanded to nothing, so that optional arguments such as a count can
+// be left out.
+//
+// The dollar signs written as $$ in the templates are not variables, but they
+// are plain dollar signs in Cmd. For an action returned by a VM or a DFA,
+// Expand uses the command from before $$ was replaced so that it can tell
+// them apart. For an action built by hand, Cmd is expanded and $$ in it is
+// replaced by $.
+func (a Action) Expand(r Resolver) (string, error) {
+	template := a.Cmd
+	if a.raw != "" {
+		template = a.raw
+	}
+	if strings.IndexByte(template, '$') < 0 {
+		return template, nil
+	}
+	buf := &bytes.Buffer{}
+	for len(template) > 0 {
+		i := strings.Index(template, "$")
+		if i < 0 {
+			break
+		}
+		buf.WriteString(template[:i])
+		template = template[i:]
+		if len(template) > 1 && template[1] == '$' {
+			// Treat $$ as $.
+			buf.WriteByte('$')
+			template = template[2:]
+			continue
+		}
+		name, num, rest, ok := extract(template)
+		if !ok {
+			// Malformed; treat $ as raw text.
+			buf.WriteByte('$')
+			template = template[1:]
+			continue
+		}
+		template = rest
+		switch {
+		case num >= len(a.Vars):
+			return "", &VarError{Name: name}
+		case num >= 0:
+			buf.WriteString(a.Quoting.Quote(format(a.Vars[num])))
+		default:
+			var val string
+			if r != nil {
+				val, ok = r.Resolve(name)
+			}
+			if !ok {
+				return "", &VarError{Name: name}
+			}
+			buf.WriteString(val)
+		}
+	}
+	buf.WriteString(template)
+	return buf.String(), nil
+}
+
+// format returns the text of a variable: runes are written as characters,
+// events made of runes and pastes as their text, and other values with their
+// default format.
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case rune:
+		return string(v)
+	case Events:
+		if v.textual() {
+			return v.Text()
+		}
+	}
+	return fmt.Sprint(v)
+}
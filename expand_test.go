@@ -1,8 +1,17 @@
 package kbd
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestExpand(t *testing.T) {
+	names := func(name string) (string, bool) {
+		if name == "count" {
+			return "3", true
+		}
+		return "", false
+	}
 	tests := []struct {
 		template string
 		args     []string
@@ -12,6 +21,8 @@ func TestExpand(t *testing.T) {
 		{"$$1", []string{}, "$1"},
 		{"$foo $0", []string{"bar"}, "$foo bar"},
 		{"$-2", []string{}, "$-2"},
+		{"$count+$pos", []string{}, "3+$pos"},
+		{"$1x", []string{}, "$1x"},
 	}
 
 	for _, tt := range tests {
@@ -20,10 +31,65 @@ func TestExpand(t *testing.T) {
 			if n != len(tt.args) {
 				t.Fatalf("nargs: %d, expected: %d", n, len(tt.args))
 			}
-			expanded := expand(tt.template, tt.args)
+			expanded := unescape(expand(tt.template, tt.args, names))
 			if expanded != tt.expect {
 				t.Fatalf("expand: %s, expected: %s", expanded, tt.expect)
 			}
 		})
 	}
 }
+
+func TestActionExpand(t *testing.T) {
+	host := ResolverFunc(func(name string) (string, bool) {
+		if name == "pos" {
+			return "10", true
+		}
+		return "", false
+	})
+	tests := []struct {
+		action Action
+		expect string
+		err    string
+	}{
+		{Action{Cmd: "insert $0", Vars: []interface{}{'x'}}, "insert x", ""},
+		{Action{Cmd: "cursor-to $pos+$1", Vars: []interface{}{nil, "w"}}, "cursor-to 10+w", ""},
+		{Action{Cmd: "price $$5"}, "price $5", ""},
+		{Action{Cmd: "goto $line"}, "", "line"},
+		{Action{Cmd: "insert $2", Vars: []interface{}{'x'}}, "", "2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action.Cmd, func(t *testing.T) {
+			got, err := tt.action.Expand(host)
+			if tt.err != "" {
+				var verr *VarError
+				if !errors.As(err, &verr) || verr.Name != tt.err {
+					t.Fatalf("got %v, expected an unknown variable %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.expect {
+				t.Fatalf("got %q, %v, expected %q", got, err, tt.expect)
+			}
+		})
+	}
+}
+
+func TestExpandDollar(t *testing.T) {
+	host := ResolverFunc(func(name string) (string, bool) {
+		return "10", name == "pos"
+	})
+	inner := Cap(MustKeys("p"), "$$1 at $pos")
+	vm := NewVM(MustCompile(Seq(Cap(Seq(inner, MustKeys("q")), "price $1 $0"), End())))
+	var action Action
+	for _, ev := range keys("pq") {
+		action, _, _ = vm.Exec(ev)
+	}
+	if expect := "price $1 at $pos $0"; action.Cmd != expect {
+		t.Fatalf("got command %q, expected %q", action.Cmd, expect)
+	}
+	got, err := action.Expand(host)
+	if expect := "price $1 at 10 pq"; err != nil || got != expect {
+		t.Fatalf("got %q, %v, expected %q", got, err, expect)
+	}
+}
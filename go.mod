@@ -4,7 +4,6 @@ go 1.18
 
 require (
 	github.com/micro-editor/tcell/v2 v2.2.2-0.20210627050507-71193250da58
-	github.com/zyedidia/generic v0.0.0-20211221212527-13c2e081a614
 	github.com/zyedidia/gpeg v0.0.0-20211118095656-b73cf96bdf80
 )
 
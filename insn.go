@@ -5,7 +5,8 @@ import (
 	"fmt"
 )
 
-// A Program is a sequence of key parsing instructions.
+// A Program is a sequence of key parsing instructions. A Program is never
+// modified once compiled, so any number of VMs can run it concurrently.
 type Program []insn
 
 func (p Program) String() string {
@@ -17,6 +18,62 @@ func (p Program) String() string {
 	return s.String()
 }
 
+// A Capture describes a capture of a program.
+type Capture struct {
+	// Template is the template of the capture.
+	Template string
+	// Pos is the position of the template in the source of the program, if
+	// known (see CapNode.At).
+	Pos Pos
+
+	// positions of the bytes of the template, if they were recorded (see
+	// CapNode.AtEach)
+	each []Pos
+}
+
+// PosOf returns the position in the source of the i-th byte of the template,
+// or of its end if i is the length of the template. It is only valid if Pos
+// is.
+func (c Capture) PosOf(i int) Pos {
+	if len(c.each) > 0 {
+		if i < len(c.each) {
+			return c.each[i]
+		}
+		// the end follows the last byte
+		pos := c.each[len(c.each)-1]
+		pos.Col++
+		return pos
+	}
+	pos := c.Pos
+	if !pos.IsValid() {
+		return pos
+	}
+	for _, r := range c.Template[:i] {
+		if r == '\n' {
+			pos.Line++
+			pos.Col = 1
+		} else {
+			pos.Col++
+		}
+	}
+	return pos
+}
+
+// Captures returns the captures of the program in the order of the program.
+func (p Program) Captures() []Capture {
+	var caps []Capture
+	for _, in := range p {
+		if t, ok := in.(iCapEnd); ok {
+			caps = append(caps, Capture{
+				Template: t.cmd,
+				Pos:      t.pos,
+				each:     t.each,
+			})
+		}
+	}
+	return caps
+}
+
 type insn interface {
 	String() string
 }
@@ -28,13 +85,39 @@ func (i iCapStart) String() string {
 }
 
 type iCapEnd struct {
-	cmd string
+	cmd   string
+	names []string
+	// number of arguments written in the capture, outside of the rules it
+	// calls
+	nargs int
+	pos   Pos
+	each  []Pos
 }
 
 func (i iCapEnd) String() string {
 	return fmt.Sprintf("cap end '%v'", i.cmd)
 }
 
+type iArgStart struct{}
+
+func (i iArgStart) String() string {
+	return "arg start"
+}
+
+type iArgEnd struct {
+	name string
+	// index of the argument in the enclosing capture, starting at 1, or 0 if
+	// the argument is in a rule called by the capture
+	index int
+}
+
+func (i iArgEnd) String() string {
+	if i.name != "" {
+		return fmt.Sprintf("arg end '%v'", i.name)
+	}
+	return "arg end"
+}
+
 type iConsume struct {
 	match Event
 }
@@ -65,6 +148,36 @@ func (i iSplit) String() string {
 	return fmt.Sprintf("split %v, %v", i.lbl1, i.lbl2)
 }
 
+// iChoice is a split where the first branch has priority over the second.
+type iChoice struct {
+	lbl1, lbl2 int
+}
+
+func (i iChoice) String() string {
+	return fmt.Sprintf("choice %v, %v", i.lbl1, i.lbl2)
+}
+
+// iPred runs the predicate that follows it up to the matching iPredEnd on the
+// upcoming events without consuming them, and then jumps past the iPredEnd if
+// the predicate succeeded.
+type iPred struct {
+	neg bool
+	lbl int
+}
+
+func (i iPred) String() string {
+	if i.neg {
+		return fmt.Sprintf("not %v", i.lbl)
+	}
+	return fmt.Sprintf("and %v", i.lbl)
+}
+
+type iPredEnd struct{}
+
+func (i iPredEnd) String() string {
+	return "pred end"
+}
+
 type iCall struct {
 	lbl int
 }
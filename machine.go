@@ -2,20 +2,76 @@ package kbd
 
 import (
 	"strconv"
-
-	"github.com/zyedidia/generic/stack"
 )
 
 type machine struct {
 	pc int // program counter
 	sp int // subject pointer
 
-	cmds []string
-	vars []interface{}
-	caps *stack.Stack[int]
-	rets *stack.Stack[int]
+	vals []value
+	vars []span
+	caps []frame
+	rets *call // return addresses of the calls in progress
+
+	// branches taken at the prioritized choices so far
+	path []branch
+
+	// scratch space for the arguments of an expansion
+	args []string
 
 	status status
+
+	// pool the machine comes from, used for forks
+	pool *pool
+}
+
+// A branch records which side of a prioritized choice a machine took. The
+// choice is identified by its pc, the subject pointer and the return stack
+// when it ran: since machines in the same state are deduplicated, only one
+// machine runs a given choice with those values.
+type branch struct {
+	pc     int
+	sp     int
+	rets   *call
+	second bool
+}
+
+// A value is the result of a completed capture. Values marked as arguments
+// were produced by an ArgNode and are bound positionally by the enclosing
+// capture, at their index if they have one, and also by name if the ArgNode
+// was named.
+type value struct {
+	s     string
+	arg   bool
+	index int
+	name  string
+	// the tree of the value, if the VM builds trees
+	node *Node
+}
+
+// A span is the range of events of a variable, from start to end in the events
+// of the VM. Values are only computed when an action is emitted, so that the
+// machines that do not win do not build them.
+type span struct {
+	start int
+	end   int
+}
+
+// A frame records where a capture or argument started: the subject pointer,
+// the number of values that existed at that point and the instruction that
+// started it.
+type frame struct {
+	sp    int
+	nvals int
+	pc    int
+}
+
+// A call is a node of a persistent stack of return addresses. Machines share
+// the nodes of their common calls, and nodes are interned by their pool so
+// that machines with the same calls in progress have the same stack.
+type call struct {
+	ret    int
+	parent *call
 }
 
 type status struct {
@@ -24,31 +80,137 @@ type status struct {
 	done    bool // finished matching (success if !failed)
 }
 
-func newMachine() *machine {
+// A pool recycles the machines of a VM, along with their slices, so that
+// running a program does not allocate once enough machines exist.
+type pool struct {
+	free  []*machine
+	calls map[call]*call
+	// whether the machines build a Node for each capture
+	tree bool
+}
+
+func newPool() *pool {
+	return &pool{
+		calls: make(map[call]*call),
+	}
+}
+
+// get returns a machine starting at the beginning of the program.
+func (p *pool) get() *machine {
+	if n := len(p.free); n > 0 {
+		m := p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+		return m
+	}
 	return &machine{
-		pc:   0,
-		sp:   0,
-		cmds: nil,
-		vars: nil,
-		caps: stack.New[int](),
-		rets: stack.New[int](),
+		pool: p,
+	}
+}
+
+// put returns machines to the pool. They must not be used afterwards.
+func (p *pool) put(ms ...*machine) {
+	for _, m := range ms {
+		*m = machine{
+			vals: m.vals[:0],
+			vars: m.vars[:0],
+			caps: m.caps[:0],
+			path: m.path[:0],
+			args: m.args[:0],
+			pool: p,
+		}
+		p.free = append(p.free, m)
 	}
 }
 
+// forget drops the interned stacks so that the stacks of finished runs can be
+// collected. It must only be called when no machine is running, since a
+// running machine would no longer share its stack with new machines.
+func (p *pool) forget() {
+	for k := range p.calls {
+		delete(p.calls, k)
+	}
+}
+
+// push returns the stack made of 'ret' on top of 'parent'.
+func (p *pool) push(parent *call, ret int) *call {
+	k := call{
+		ret:    ret,
+		parent: parent,
+	}
+	c, ok := p.calls[k]
+	if !ok {
+		c = &k
+		p.calls[k] = c
+	}
+	return c
+}
+
 // copy the machine but start it at a new pc
 func (m *machine) cpy(pc int) *machine {
-	cmds := make([]string, len(m.cmds))
-	vars := make([]interface{}, len(m.vars))
-	copy(cmds, m.cmds)
-	copy(vars, m.vars)
-	return &machine{
-		pc:     pc,
-		sp:     m.sp,
-		cmds:   cmds,
-		vars:   vars,
-		caps:   m.caps.Copy(),
-		rets:   m.rets.Copy(),
-		status: m.status,
+	f := m.pool.get()
+	f.pc = pc
+	f.sp = m.sp
+	f.vals = append(f.vals, m.vals...)
+	f.vars = append(f.vars, m.vars...)
+	f.caps = append(f.caps, m.caps...)
+	f.path = append(f.path, m.path...)
+	f.rets = m.rets
+	f.status = m.status
+	return f
+}
+
+// fork splits the machine: m continues at pc1 and the returned copy starts at
+// pc2.
+func (m *machine) fork(pc1, pc2 int) *machine {
+	f := m.cpy(pc2)
+	m.pc = pc1
+	return f
+}
+
+// choose splits the machine at a prioritized choice, recording the branch
+// taken by m and by the returned copy.
+func (m *machine) choose(pc1, pc2 int) *machine {
+	b := branch{
+		pc:   m.pc,
+		sp:   m.sp,
+		rets: m.rets,
+	}
+	f := m.fork(pc1, pc2)
+	m.path = append(m.path, b)
+	b.second = true
+	f.path = append(f.path, b)
+	return f
+}
+
+// preferred returns true if m has priority over o, that is if the two
+// machines diverged at a prioritized choice and m took its first branch.
+// Machines that diverged at an unordered split have different choices at the
+// first difference of their paths, or no difference at all.
+func (m *machine) preferred(o *machine) bool {
+	for i := 0; i < len(m.path) && i < len(o.path); i++ {
+		p, q := m.path[i], o.path[i]
+		if p != q {
+			return p.pc == q.pc && p.sp == q.sp && p.rets == q.rets && !p.second && q.second
+		}
+	}
+	return false
+}
+
+// A state identifies what a machine can match from now on: two machines with
+// the same state match the same events, and only the one with the highest
+// priority needs to be kept.
+type state struct {
+	pc   int
+	sp   int
+	rets *call
+}
+
+func (m *machine) state() state {
+	return state{
+		pc:   m.pc,
+		sp:   m.sp,
+		rets: m.rets,
 	}
 }
 
@@ -57,7 +219,9 @@ func (m *machine) done(success bool) {
 	m.status.failed = !success
 }
 
-func (m *machine) step(prog Program, evs events) (splitpc int, ok bool) {
+// step executes one instruction. If the instruction is a split, the machine
+// for the second branch is returned.
+func (m *machine) step(prog Program, evs events) (fork *machine) {
 	if m.pc < 0 || m.pc >= len(prog) {
 		m.done(true)
 		return
@@ -70,11 +234,11 @@ func (m *machine) step(prog Program, evs events) (splitpc int, ok bool) {
 		m.done(true)
 		return
 	case iCall:
-		m.rets.Push(m.pc + 1)
+		m.rets = m.pool.push(m.rets, m.pc+1)
 		m.pc = t.lbl
 	case iRet:
-		ret := m.rets.Pop()
-		m.pc = ret
+		m.pc = m.rets.ret
+		m.rets = m.rets.parent
 	case iConsume:
 		if m.sp >= len(evs) {
 			m.status.blocked = true
@@ -86,59 +250,206 @@ func (m *machine) step(prog Program, evs events) (splitpc int, ok bool) {
 		}
 		m.sp++
 		m.pc++
+	case iPred:
+		matched, decided := m.lookahead(prog, evs, m.pc+1)
+		if !decided {
+			// wait for more events before deciding
+			m.status.blocked = true
+			return
+		}
+		if matched == t.neg {
+			m.done(false)
+			return
+		}
+		m.pc += t.lbl
+	case iPredEnd:
+		// only reached by the machines started by lookahead
+		m.done(true)
+		return
 	case iJump:
 		m.pc += t.lbl
 	case iSplit:
-		newpc := m.pc + t.lbl2
-		m.pc += t.lbl1
-		return newpc, true
-	case iCapStart:
-		m.caps.Push(m.sp)
+		return m.fork(m.pc+t.lbl1, m.pc+t.lbl2)
+	case iChoice:
+		return m.choose(m.pc+t.lbl1, m.pc+t.lbl2)
+	case iCapStart, iArgStart:
+		m.caps = append(m.caps, frame{
+			sp:    m.sp,
+			nvals: len(m.vals),
+			pc:    m.pc,
+		})
+		m.pc++
+	case iArgEnd:
+		f := m.pop()
+		// the argument's value is the last value produced inside it, or the
+		// matched events if nothing was produced
+		var arg string
+		var node *Node
+		if len(m.vals) > f.nvals {
+			arg = m.vals[len(m.vals)-1].s
+			node = m.vals[len(m.vals)-1].node
+		} else {
+			arg = m.mkvar(f.sp, m.sp)
+			if m.pool.tree {
+				node = &Node{
+					Value: evs.value(f.sp, m.sp),
+				}
+			}
+		}
+		m.vals = append(m.vals[:f.nvals], value{
+			s:     arg,
+			arg:   true,
+			index: t.index,
+			name:  t.name,
+			node:  node,
+		})
 		m.pc++
 	case iCapEnd:
 		// this is confusing so it is heavily commented
-		last := m.caps.Pop()
-		n, zero := nargs(t.cmd)
-		n-- // we only care about the number of args after arg 0
-		// the zero arg corresponds to a capture of all the events
-		var arg0 interface{}
-		if zero && m.sp-last == 1 {
-			// one event, encode it directly (TODO)
-			arg0 = evs.slice(last, m.sp)
-		} else if zero {
-			// multiple events, get the concatenated slice as a string (meant
-			// to be used only for rune events).
-			arg0 = evs.slice(last, m.sp)
-		}
+		f := m.pop()
+		_, zero := nargs(t.cmd)
+		// the zero arg corresponds to a capture of all the events: add their
+		// value to the var list and get its name
 		var arg0name string
 		if zero {
-			// add arg0 to the var list and get its name
-			arg0name = m.mkvar(arg0)
-		}
-		// how many additional arguments do we need?
-		var args []string
-		if n > 0 {
-			// if there are additional arguments fetch them out of m.cmds and
-			// remove them from m.cmds
-			ln := len(m.cmds)
-			// last n values in m.cmds are the args
-			args = m.cmds[ln-n : ln]
-			// remove the last n vals
-			m.cmds = m.cmds[:ln-n]
-		}
-		// args are arg0 plus any additional args
-		args = append([]string{arg0name}, args...)
-		// perform expansion
-		result := expand(t.cmd, args)
-		// add the result directly into m.cmds
-		m.cmds = append(m.cmds, result)
+			arg0name = m.mkvar(f.sp, m.sp)
+		}
+		// the values produced inside this capture are its arguments: if any
+		// of them were marked with Arg only those are used, otherwise every
+		// value is used in order. The arguments written in the capture have
+		// a fixed index, so that one that did not match is empty rather than
+		// shifting the others
+		vals := m.vals[f.nvals:]
+		args := append(m.args[:0], arg0name)
+		for i := 0; i < t.nargs; i++ {
+			args = append(args, "")
+		}
+		positional := t.nargs > 0
+		for _, v := range vals {
+			if !v.arg {
+				continue
+			}
+			if v.index > 0 {
+				args[v.index] = v.s
+			} else {
+				args = append(args, v.s)
+			}
+			positional = true
+		}
+		if !positional {
+			for _, v := range vals {
+				args = append(args, v.s)
+			}
+		}
+		var node *Node
+		if m.pool.tree {
+			node = newNode(t, vals, positional, evs.value(f.sp, m.sp))
+		}
+		// perform expansion and replace the consumed values with the result.
+		// Named arguments are looked up among the values, and the names that
+		// are not declared by this capture are left for Action.Expand
+		result := expand(t.cmd, args, func(name string) (string, bool) {
+			for i := len(vals) - 1; i >= 0; i-- {
+				if vals[i].name == name {
+					return vals[i].s, true
+				}
+			}
+			for _, n := range t.names {
+				if n == name {
+					return "", true
+				}
+			}
+			return "", false
+		})
+		m.args = args
+		m.vals = append(m.vals[:f.nvals], value{
+			s:    result,
+			node: node,
+		})
 
 		m.pc++
 	}
 	return
 }
 
-func (m *machine) mkvar(val interface{}) string {
-	m.vars = append(m.vars, val)
+// lookahead runs the predicate starting at pc on the events following m.sp
+// without modifying m. It returns whether the predicate matched, and whether
+// that could be decided with the events seen so far.
+func (m *machine) lookahead(prog Program, evs events, pc int) (matched, decided bool) {
+	sub := m.pool.get()
+	sub.pc = pc
+	sub.sp = m.sp
+	sub.rets = m.rets
+	machines := []*machine{sub}
+	defer func() {
+		m.pool.put(machines...)
+	}()
+
+	for len(machines) > 0 {
+		progress := false
+		for i := 0; i < len(machines); i++ {
+			sub := machines[i]
+			if sub.status.blocked {
+				continue
+			}
+			progress = true
+			if fork := sub.step(prog, evs); fork != nil {
+				machines = append(machines, fork)
+			}
+			if sub.status.done {
+				if !sub.status.failed {
+					return true, true
+				}
+				m.pool.put(sub)
+				machines = append(machines[:i], machines[i+1:]...)
+				i--
+			}
+		}
+		if !progress {
+			return false, false
+		}
+	}
+	return false, true
+}
+
+// templates returns the command templates of the captures that m is inside
+// of, innermost first.
+func (m *machine) templates(prog Program) []string {
+	var cmds []string
+	for i := len(m.caps) - 1; i >= 0; i-- {
+		f := m.caps[i]
+		if _, ok := prog[f.pc].(iCapStart); !ok {
+			continue
+		}
+		// find the end of the capture, skipping nested captures
+		depth := 0
+		for pc := f.pc + 1; pc < len(prog); pc++ {
+			if _, ok := prog[pc].(iCapStart); ok {
+				depth++
+			} else if t, ok := prog[pc].(iCapEnd); ok {
+				if depth == 0 {
+					cmds = append(cmds, t.cmd)
+					break
+				}
+				depth--
+			}
+		}
+	}
+	return cmds
+}
+
+// pop removes the innermost capture frame.
+func (m *machine) pop() frame {
+	f := m.caps[len(m.caps)-1]
+	m.caps = m.caps[:len(m.caps)-1]
+	return f
+}
+
+// mkvar adds a variable for the events from start to end and returns its name.
+func (m *machine) mkvar(start, end int) string {
+	m.vars = append(m.vars, span{
+		start: start,
+		end:   end,
+	})
 	return "$" + strconv.Itoa(len(m.vars)-1)
 }
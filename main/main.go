@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"time"
 
 	"github.com/micro-editor/tcell/v2"
 	"github.com/zyedidia/kbd"
@@ -24,11 +25,31 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	prog := syntax.MustCompile("micro", string(data))
+	prog, warnings, err := syntax.CompileWarnings(os.Args[1], string(data))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, w := range warnings {
+		log.Println("warning:", w)
+	}
+	// the actions of the demo use the command language of package action
+	if err := syntax.CheckActions(os.Args[1], string(data)); err != nil {
+		log.Fatal(err)
+	}
 	// prog := vim()
-	log.Println(prog.Compile())
+	code, err := kbd.Compile(prog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println(code)
+
+	vm := kbd.NewVM(code)
+	vm.SetTimeout(time.Second)
 
-	vm := kbd.NewVM(prog.Compile())
+	// there is no buffer in this demo, so the cursor is always at the start
+	host := kbd.ResolverFunc(func(name string) (string, bool) {
+		return "0", name == "pos"
+	})
 
 	s, e := tcell.NewScreen()
 	if e != nil {
@@ -42,10 +63,36 @@ func main() {
 
 	for {
 		ev := s.PollEvent()
-		action, ok, more := vm.Exec(ev)
+		var action kbd.Action
+		var ok, more bool
+		if _, tick := ev.(*tcell.EventInterrupt); tick {
+			action, ok, more = vm.Tick()
+		} else {
+			action, ok, more = vm.Exec(ev)
+		}
+		if deadline, wait := vm.Deadline(); wait {
+			// wake up the loop when the pending keys time out
+			time.AfterFunc(time.Until(deadline), func() {
+				s.PostEvent(tcell.NewEventInterrupt(nil))
+			})
+		}
 		log.Println(action.Cmd, ok, more)
-		for i, v := range action.Vars {
-			log.Printf("\t$%d: %v\n", i, v)
+		for ok {
+			for i, v := range action.Vars {
+				log.Printf("\t$%d: %v\n", i, v)
+			}
+			if cmd, err := action.Expand(host); err != nil {
+				log.Println("error:", err)
+			} else {
+				log.Println("\t=>", cmd)
+			}
+			// one event may complete several actions in longest-match mode
+			if action, ok = vm.Next(); ok {
+				log.Println(action.Cmd, ok, more)
+			}
+		}
+		for _, d := range vm.Discarded() {
+			log.Printf("discarded %v\n", d)
 		}
 		if !more {
 			vm.Reset()
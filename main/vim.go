@@ -32,12 +32,12 @@ func vim() k.Pattern {
 	// )
 
 	action := k.Alt(
-		k.Cap(k.Seq(k.MustLit("Z"), k.MustLit("Z")), "save; quit"),
+		k.Cap(k.MustKeys("ZZ"), "save; quit"),
 		k.Cap(move, "cursor-to [+ $pos [$1]]"),
 	)
 
 	raction := k.Alt(
-		k.Cap(k.Seq(k.MustLit("d"), k.MustLit("d")), "delete-line"),
+		k.Cap(k.MustKeys("dd"), "delete-line"),
 		k.Cap(k.Seq(k.MustLit("d"), move), "delete-range $pos [+ $pos [$1]]"),
 		k.Cap(k.MustLit("D"), "exec 'd$'"),
 	)
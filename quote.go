@@ -0,0 +1,184 @@
+package kbd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrQuote is the error for a string that is not a single quoted word.
+var ErrQuote = errors.New("malformed quoted word")
+
+// A Quoting is the set of quoting rules of the language of the actions. When
+// an action is expanded, the values of its variables are quoted so that each
+// of them parses back to a single word with the same text, whatever the
+// characters it contains.
+type Quoting int
+
+const (
+	// ActionQuoting quotes values for the action language of the grammars:
+	// words that contain special characters are put in single quotes, in
+	// which \\, \', \n, \r and \t are escapes.
+	ActionQuoting Quoting = iota
+	// ShellQuoting quotes values for a POSIX shell.
+	ShellQuoting
+	// JSONQuoting turns every value into a JSON string.
+	JSONQuoting
+	// Verbatim does not quote values.
+	Verbatim
+)
+
+// Quote returns 's' quoted as a single word.
+func (q Quoting) Quote(s string) string {
+	switch q {
+	case ActionQuoting:
+		if s != "" && strings.IndexFunc(s, special) < 0 {
+			return s
+		}
+		buf := &bytes.Buffer{}
+		buf.WriteByte('\'')
+		for _, r := range s {
+			switch r {
+			case '\\', '\'':
+				buf.WriteByte('\\')
+				buf.WriteRune(r)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\t':
+				buf.WriteString(`\t`)
+			default:
+				buf.WriteRune(r)
+			}
+		}
+		buf.WriteByte('\'')
+		return buf.String()
+	case ShellQuoting:
+		if s != "" && strings.IndexFunc(s, special) < 0 {
+			return s
+		}
+		// a single quote cannot be escaped inside single quotes, so the
+		// quotes are closed around an escaped one
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	case JSONQuoting:
+		buf := &bytes.Buffer{}
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(s)
+		return strings.TrimSuffix(buf.String(), "\n")
+	}
+	return s
+}
+
+// Unquote returns the text of the word 's', which must be quoted as Quote
+// would. It returns ErrQuote if 's' is not a single word.
+func (q Quoting) Unquote(s string) (string, error) {
+	switch q {
+	case ActionQuoting:
+		return unquoteAction(s)
+	case ShellQuoting:
+		return unquoteShell(s)
+	case JSONQuoting:
+		var text string
+		if err := json.Unmarshal([]byte(s), &text); err != nil {
+			return "", ErrQuote
+		}
+		return text, nil
+	}
+	return s, nil
+}
+
+// special reports whether a word containing 'r' must be quoted. The same
+// characters are safe in the action language and in the shell.
+func special(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-_.+/:,=@%", r)
+}
+
+func unquoteAction(s string) (string, error) {
+	if len(s) == 0 {
+		return "", ErrQuote
+	}
+	quote := s[0]
+	if quote != '\'' && quote != '"' {
+		if strings.IndexFunc(s, special) >= 0 {
+			return "", ErrQuote
+		}
+		return s, nil
+	}
+	if len(s) < 2 || s[len(s)-1] != quote {
+		return "", ErrQuote
+	}
+	body := s[1 : len(s)-1]
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == quote:
+			return "", ErrQuote
+		case c != '\\':
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(body) {
+			return "", ErrQuote
+		}
+		switch body[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		default:
+			buf.WriteByte(body[i])
+		}
+	}
+	return buf.String(), nil
+}
+
+func unquoteShell(s string) (string, error) {
+	if len(s) == 0 {
+		return "", ErrQuote
+	}
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return "", ErrQuote
+			}
+			buf.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				// only these characters can be escaped in double quotes
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+				}
+				buf.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return "", ErrQuote
+			}
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", ErrQuote
+			}
+			buf.WriteByte(s[i])
+		default:
+			if c < utf8.RuneSelf && special(rune(c)) {
+				return "", ErrQuote
+			}
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,109 @@
+package kbd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/micro-editor/tcell/v2"
+)
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		quoting Quoting
+		s       string
+		expect  string
+	}{
+		{ActionQuoting, "word", "word"},
+		{ActionQuoting, "", "''"},
+		{ActionQuoting, "a b; c [d] $e", "'a b; c [d] $e'"},
+		{ActionQuoting, "it's\n", `'it\'s\n'`},
+		{ShellQuoting, "-n=3", "-n=3"},
+		{ShellQuoting, "it's $HOME", `'it'\''s $HOME'`},
+		{JSONQuoting, "a\"<b>", `"a\"<b>"`},
+		{Verbatim, "a b", "a b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := tt.quoting.Quote(tt.s); got != tt.expect {
+				t.Fatalf("got %s, expected %s", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestQuoteRoundTrip(t *testing.T) {
+	values := []string{
+		"",
+		"word",
+		"two words",
+		"insert $0; quit",
+		"[cmd] {block}",
+		`'single' "double" \back\`,
+		"line\nbreak\ttab\rreturn",
+		"ünïcode ☺",
+		"'",
+		"\\",
+	}
+
+	for _, quoting := range []Quoting{ActionQuoting, ShellQuoting, JSONQuoting} {
+		for _, s := range values {
+			quoted := quoting.Quote(s)
+			got, err := quoting.Unquote(quoted)
+			if err != nil || got != s {
+				t.Fatalf("quoting %d: %q quoted as %s unquoted to %q, %v", quoting, s, quoted, got, err)
+			}
+		}
+	}
+}
+
+func TestUnquoteErrors(t *testing.T) {
+	tests := []struct {
+		quoting Quoting
+		s       string
+	}{
+		{ActionQuoting, "two words"},
+		{ActionQuoting, "'open"},
+		{ActionQuoting, "'a'b'"},
+		{ShellQuoting, "a;b"},
+		{ShellQuoting, `"open`},
+		{JSONQuoting, "bare"},
+	}
+
+	for _, tt := range tests {
+		if _, err := tt.quoting.Unquote(tt.s); !errors.Is(err, ErrQuote) {
+			t.Fatalf("%s: got %v, expected %v", tt.s, err, ErrQuote)
+		}
+	}
+}
+
+func TestExpandQuoting(t *testing.T) {
+	action := Action{
+		Cmd:  "insert $0",
+		Vars: []interface{}{"a]; quit"},
+	}
+	for quoting, expect := range map[Quoting]string{
+		ActionQuoting: `insert 'a]; quit'`,
+		ShellQuoting:  `insert 'a]; quit'`,
+		JSONQuoting:   `insert "a]; quit"`,
+		Verbatim:      `insert a]; quit`,
+	} {
+		action.Quoting = quoting
+		got, err := action.Expand(nil)
+		if err != nil || got != expect {
+			t.Fatalf("quoting %d: got %q, %v, expected %q", quoting, got, err, expect)
+		}
+	}
+}
+
+func TestSetQuoting(t *testing.T) {
+	vm := NewVM(MustCompile(Seq(Cap(MustLit("paste"), "insert $0"), End())))
+	vm.SetQuoting(ShellQuoting)
+	action, ok, _ := vm.Exec(tcell.NewEventPaste("it's"))
+	if !ok {
+		t.Fatal("no action")
+	}
+	if got, _ := action.Expand(nil); got != `insert 'it'\''s'` {
+		t.Fatalf("got %q", got)
+	}
+}
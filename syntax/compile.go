@@ -2,15 +2,19 @@ package syntax
 
 import (
 	"bytes"
-	"fmt"
+	"errors"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/zyedidia/gpeg/charset"
 	"github.com/zyedidia/gpeg/memo"
 	"github.com/zyedidia/gpeg/pattern"
 	"github.com/zyedidia/gpeg/vm"
 	"github.com/zyedidia/kbd"
+	"github.com/zyedidia/kbd/action"
+	"github.com/zyedidia/kbd/cbind"
 )
 
 var parser vm.Code
@@ -20,66 +24,146 @@ func init() {
 	parser = vm.Encode(prog)
 }
 
-func compile(name string, root *memo.Capture, s string) kbd.Pattern {
+func compile(name string, root *memo.Capture, s string) (kbd.Pattern, error) {
 	var p kbd.Pattern
+	var err error
 	switch root.Id() {
 	case idPattern:
-		p = compile(name, root.Child(0), s)
+		p, err = compile(name, root.Child(0), s)
 	case idGrammar:
-		nonterms := make(map[string]kbd.Pattern)
+		// rules are laid out in the order they are defined
+		var rules []kbd.Rule
+		defined := make(map[string]bool)
 		it := root.ChildIterator(0)
 		for c := it(); c != nil; c = it() {
-			k, v := compileDef(name, c, s)
-			nonterms[k] = v
+			k, v, err := compileDef(name, c, s)
+			if err != nil {
+				return nil, err
+			}
+			if defined[k] {
+				return nil, newError(name, s, c.Start(), "rule %q is already defined", k)
+			}
+			defined[k] = true
+			rules = append(rules, kbd.Rule{
+				Name:    k,
+				Pattern: v,
+			})
 		}
-		p = kbd.Grammar("bindings", nonterms)
+		p = kbd.Rules("bindings", rules...)
 	case idExpression:
-		alternations := make([]kbd.Pattern, 0, root.NumChildren())
-		it := root.ChildIterator(0)
-		for c := it(); c != nil; c = it() {
-			alternations = append(alternations, compile(name, c, s))
+		var choices []kbd.Pattern
+		choices, err = compileChildren(name, root, s)
+		if err == nil {
+			p = kbd.Choice(choices...)
+		}
+	case idAlternation:
+		var alternations []kbd.Pattern
+		alternations, err = compileChildren(name, root, s)
+		if err == nil {
+			p = kbd.Alt(alternations...)
 		}
-		p = kbd.Alt(alternations...)
 	case idSequence:
 		concats := make([]kbd.Pattern, 0, root.NumChildren())
+		var action *memo.Capture
 		it := root.ChildIterator(0)
 		for c := it(); c != nil; c = it() {
-			concats = append(concats, compile(name, c, s))
+			if c.Id() == idAction {
+				// a trailing action block captures the whole sequence
+				action = c
+				continue
+			}
+			cp, err := compile(name, c, s)
+			if err != nil {
+				return nil, err
+			}
+			concats = append(concats, cp)
+		}
+		if len(concats) == 0 {
+			return nil, newError(name, s, root.Start(), "expected a pattern")
 		}
 		p = kbd.Seq(concats...)
-	case idSuffix:
+		if action != nil {
+			cmd, start := body(action, s)
+			p = kbd.Cap(p, cmd).At(position(name, s, start))
+		}
+	case idPrefix:
 		if root.NumChildren() == 2 {
+			var sub kbd.Pattern
+			sub, err = compile(name, root.Child(1), s)
+			switch {
+			case err != nil:
+			case root.Child(0).Id() == idAND:
+				p = kbd.And(sub)
+			case root.Child(0).Id() == idNOT:
+				p = kbd.Not(sub)
+			}
+		} else {
+			p, err = compile(name, root.Child(0), s)
+		}
+	case idSuffix:
+		p, err = compile(name, root.Child(0), s)
+		if err == nil && root.NumChildren() == 2 {
 			c := root.Child(1)
 			switch c.Id() {
 			case idQUESTION:
-				p = kbd.Opt(compile(name, root.Child(0), s))
+				p = kbd.Opt(p)
 			case idSTAR:
-				p = kbd.Star(compile(name, root.Child(0), s))
+				p = kbd.Star(p)
 			case idPLUS:
-				p = kbd.Plus(compile(name, root.Child(0), s))
+				p = kbd.Plus(p)
 			}
-		} else {
-			p = compile(name, root.Child(0), s)
 		}
 	case idPrimary:
 		switch root.Child(0).Id() {
+		case idDOLLAR:
+			// a named capture is an argument that can also be referred to by
+			// name
+			var npatt kbd.Pattern
+			npatt, err = compile(name, root.Child(3), s)
+			if err == nil {
+				p = kbd.Named(parseId(root.Child(1), s), npatt)
+			}
 		case idBRACEO:
-			cpatt := compile(name, root.Child(1), s)
-			group := literal(root.Child(2), s)
-			p = kbd.Cap(cpatt, group)
+			var cpatt kbd.Pattern
+			cpatt, err = compile(name, root.Child(1), s)
+			if err != nil {
+				break
+			}
+			if c := root.Child(2); c.Id() == idAction {
+				group, start := body(c, s)
+				p = kbd.Cap(cpatt, group).At(position(name, s, start))
+			} else {
+				// the escapes of the literal are removed from the template,
+				// so each of its bytes has its own position
+				group, offsets := literal(c, s)
+				each := make([]kbd.Pos, len(offsets))
+				for i, off := range offsets {
+					each[i] = position(name, s, off)
+				}
+				// an empty template starts after the quote
+				p = kbd.Cap(cpatt, group).At(position(name, s, c.Start()+1)).AtEach(each)
+			}
+		case idLANGLE:
+			// a bracketed reference is a call whose result is bound to the
+			// next positional argument of the enclosing capture
+			p = kbd.Arg(kbd.NonTerm(parseId(root.Child(1), s)))
 		case idIdentifier, idLiteral, idClass:
-			p = compile(name, root.Child(0), s)
+			p, err = compile(name, root.Child(0), s)
 		case idOPEN:
-			p = compile(name, root.Child(1), s)
+			p, err = compile(name, root.Child(1), s)
 		case idDOT:
 			p = kbd.AnyRune()
 		}
 	case idLiteral:
-		p = kbd.MustLit(literal(root, s))
+		lit, offsets := literal(root, s)
+		p, err = kbd.Keys(lit)
+		if err != nil {
+			return nil, keyError(name, s, lit, offsets, root.Start(), err)
+		}
 	case idClass:
 		var set charset.Set
 		if root.NumChildren() <= 0 {
-			break
+			return nil, newError(name, s, root.Start(), "empty character class")
 		}
 		complement := false
 		if root.Child(0).Id() == idCARAT {
@@ -101,7 +185,35 @@ func compile(name string, root *memo.Capture, s string) kbd.Pattern {
 	case idIdentifier:
 		p = kbd.NonTerm(parseId(root, s))
 	}
-	return p
+	return p, err
+}
+
+func compileChildren(name string, root *memo.Capture, s string) ([]kbd.Pattern, error) {
+	patts := make([]kbd.Pattern, 0, root.NumChildren())
+	it := root.ChildIterator(0)
+	for c := it(); c != nil; c = it() {
+		p, err := compile(name, c, s)
+		if err != nil {
+			return nil, err
+		}
+		patts = append(patts, p)
+	}
+	return patts, nil
+}
+
+// keyError converts an error from decoding the literal 'lit' into an error
+// pointing at the offending key in the grammar. The literal starts at byte
+// 'start' of the grammar and offsets maps each byte of the literal to its
+// position in the grammar.
+func keyError(name, s, lit string, offsets []int, start int, err error) error {
+	var nerr *cbind.NotationError
+	if errors.As(err, &nerr) && nerr.Offset < len(offsets) {
+		return newError(name, s, offsets[nerr.Offset], "invalid key %q", nerr.Token)
+	}
+	if len(lit) == 0 {
+		return newError(name, s, start, "empty literal")
+	}
+	return newError(name, s, offsets[0], "unknown key name %q", lit)
 }
 
 var special = map[byte]byte{
@@ -141,19 +253,31 @@ func parseId(root *memo.Capture, s string) string {
 	return ident.String()
 }
 
-func literal(root *memo.Capture, s string) string {
+// literal returns the unescaped contents of a literal, along with the offset
+// in 's' of each of its bytes.
+func literal(root *memo.Capture, s string) (string, []int) {
 	lit := &bytes.Buffer{}
+	var offsets []int
 	it := root.ChildIterator(0)
 	for c := it(); c != nil; c = it() {
 		lit.WriteByte(parseChar(s[c.Start():c.End()]))
+		offsets = append(offsets, c.Start())
 	}
-	return lit.String()
+	return lit.String(), offsets
+}
+
+// body returns the text of an action block and its offset in the grammar.
+func body(root *memo.Capture, s string) (string, int) {
+	raw := s[root.Start():root.End()]
+	start := root.Start() + len(raw) - len(strings.TrimLeftFunc(raw, unicode.IsSpace))
+	return strings.TrimSpace(raw), start
 }
 
-func compileDef(name string, root *memo.Capture, s string) (string, kbd.Pattern) {
+func compileDef(name string, root *memo.Capture, s string) (string, kbd.Pattern, error) {
 	id := root.Child(0)
 	exp := root.Child(1)
-	return parseId(id, s), compile(name, exp, s)
+	p, err := compile(name, exp, s)
+	return parseId(id, s), p, err
 }
 
 func compileSet(root *memo.Capture, s string) charset.Set {
@@ -168,22 +292,160 @@ func compileSet(root *memo.Capture, s string) charset.Set {
 	return charset.Set{}
 }
 
-func Compile(name, s string) (p kbd.Pattern, err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			err = e.(error)
+// Compile parses the grammar 's' and compiles it to a pattern. The name is used
+// to report the position of errors, which are of type *Error, or ErrorList if
+// the grammar references rules that are not defined. The actions are not
+// checked, since they may be written in any language (see CheckActions).
+func Compile(name, s string) (kbd.Pattern, error) {
+	p, _, err := CompileWarnings(name, s)
+	return p, err
+}
+
+// CompileWarnings is like Compile but also returns warnings about rules that
+// can never be reached from the root rule.
+func CompileWarnings(name, s string) (kbd.Pattern, []*Error, error) {
+	match, n, ast, errs := parser.Exec(strings.NewReader(s), memo.NoneTable{})
+	if len(errs) != 0 {
+		return nil, nil, parseError(name, s, errs[0].Pos)
+	}
+	if !match {
+		return nil, nil, parseError(name, s, n)
+	}
+
+	p, err := compile(name, ast.Child(0), s)
+	if err != nil {
+		return nil, nil, err
+	}
+	g, ok := p.(*kbd.GrammarNode)
+	if !ok {
+		return p, nil, nil
+	}
+
+	undefined, unreachable, err := g.Check()
+	if err != nil {
+		return nil, nil, err
+	}
+	defs := make(map[string]int)
+	refs := make(map[string]int)
+	rulePositions(ast.Child(0), s, defs, refs)
+	if len(undefined) > 0 {
+		var errs ErrorList
+		for _, rule := range undefined {
+			if pos, ok := refs[rule]; ok {
+				errs = append(errs, newError(name, s, pos, "undefined rule %q", rule))
+			} else {
+				errs = append(errs, newError(name, s, 0, "missing root rule %q", rule))
+			}
 		}
-	}()
+		errs.sort()
+		return nil, nil, errs
+	}
+	var warnings ErrorList
+	for _, rule := range unreachable {
+		warnings = append(warnings, newError(name, s, defs[rule], "rule %q is never used", rule))
+	}
+	warnings.sort()
+	return p, warnings, nil
+}
 
+// CheckActions parses the grammar 's' and checks that its actions are valid
+// scripts of the command language of package action. It returns the syntax
+// error of the grammar, if any, or else the errors of its actions as an
+// ErrorList, or nil if every action is valid. It is meant for grammars whose
+// actions are run by package action, since other hosts may use a different
+// language (see kbd.VM.SetQuoting).
+func CheckActions(name, s string) error {
 	match, n, ast, errs := parser.Exec(strings.NewReader(s), memo.NoneTable{})
 	if len(errs) != 0 {
-		return nil, errs[0]
+		return parseError(name, s, errs[0].Pos)
 	}
 	if !match {
-		return nil, fmt.Errorf("Invalid PEG: failed at %d", n)
+		return parseError(name, s, n)
+	}
+	var aerrs ErrorList
+	checkActions(name, ast.Child(0), s, &aerrs)
+	if len(aerrs) == 0 {
+		return nil
 	}
+	aerrs.sort()
+	return aerrs
+}
 
-	return compile(name, ast.Child(0), s), nil
+// checkActions appends the errors of the actions below 'root' to 'errs'.
+func checkActions(name string, root *memo.Capture, s string, errs *ErrorList) {
+	switch root.Id() {
+	case idAction:
+		cmd, start := body(root, s)
+		if err := checkAction(cmd); err != nil {
+			*errs = append(*errs, newError(name, s, start+err.Pos, "%s", err.Msg))
+		}
+		return
+	case idPrimary:
+		if root.Child(0).Id() == idBRACEO && root.Child(2).Id() == idLiteral {
+			c := root.Child(2)
+			cmd, offsets := literal(c, s)
+			if err := checkAction(cmd); err != nil {
+				pos := c.Start()
+				if err.Pos < len(offsets) {
+					pos = offsets[err.Pos]
+				}
+				*errs = append(*errs, newError(name, s, pos, "%s", err.Msg))
+			}
+		}
+	}
+	it := root.ChildIterator(0)
+	for c := it(); c != nil; c = it() {
+		checkActions(name, c, s, errs)
+	}
+}
+
+// checkAction returns the syntax error of an action, if any.
+func checkAction(cmd string) *action.Error {
+	_, err := action.Parse(cmd)
+	var aerr *action.Error
+	if errors.As(err, &aerr) {
+		return aerr
+	}
+	return nil
+}
+
+// rulePositions records the position of each rule definition in 'defs' and of
+// the first reference to each rule in 'refs'.
+func rulePositions(root *memo.Capture, s string, defs, refs map[string]int) {
+	switch root.Id() {
+	case idDefinition:
+		id := root.Child(0)
+		defs[parseId(id, s)] = id.Start()
+		rulePositions(root.Child(1), s, defs, refs)
+		return
+	case idIdentifier:
+		id := parseId(root, s)
+		if _, ok := refs[id]; !ok {
+			refs[id] = root.Start()
+		}
+		return
+	}
+	it := root.ChildIterator(0)
+	for c := it(); c != nil; c = it() {
+		rulePositions(c, s, defs, refs)
+	}
+}
+
+// parseError describes the failure to parse 's' at byte 'pos'.
+func parseError(name, s string, pos int) error {
+	if pos >= len(s) {
+		return newError(name, s, pos, "unexpected end of input")
+	}
+	switch s[pos] {
+	case '\'', '"':
+		return newError(name, s, pos, "unterminated literal")
+	case '[':
+		return newError(name, s, pos, "unterminated character class")
+	case '{':
+		return newError(name, s, pos, "unterminated action")
+	}
+	r, _ := utf8.DecodeRuneInString(s[pos:])
+	return newError(name, s, pos, "unexpected %q", r)
 }
 
 func MustCompile(name, s string) kbd.Pattern {
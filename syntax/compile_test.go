@@ -0,0 +1,147 @@
+package syntax
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zyedidia/kbd"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// same fails the test if the two patterns do not compile to the same program.
+func same(t *testing.T, p, expect kbd.Pattern) {
+	t.Helper()
+	prog := kbd.MustCompile(p)
+	eprog := kbd.MustCompile(expect)
+	if prog.String() != eprog.String() {
+		t.Fatalf("got:\n%v\nexpected:\n%v", prog, eprog)
+	}
+}
+
+func TestPostfixAction(t *testing.T) {
+	tests := []struct {
+		postfix string
+		capture string
+	}{
+		{`'a' 'b' { foo; bar }`, `{ 'a' 'b', 'foo; bar' }`},
+		{`. { insert $0 }`, `{ ., 'insert $0' }`},
+		{`'a' { for { set i 0 } { incr i } }`, `{ 'a', 'for { set i 0 } { incr i }' }`},
+		{`'a' { insert '}' }`, `{ 'a', 'insert \'}\'' }`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.postfix, func(t *testing.T) {
+			p1, err := Compile("test", tt.postfix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p2, err := Compile("test", tt.capture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			same(t, p1, p2)
+		})
+	}
+}
+
+func TestAlternation(t *testing.T) {
+	p, err := Compile("test", `'a' { x } | 'b' { y } / 'c' { z }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := kbd.Choice(
+		kbd.Alt(kbd.Cap(kbd.MustKeys("a"), "x"), kbd.Cap(kbd.MustKeys("b"), "y")),
+		kbd.Cap(kbd.MustKeys("c"), "z"),
+	)
+	same(t, p, expect)
+}
+
+func TestPredicates(t *testing.T) {
+	p, err := Compile("test", `'d' !'d' . { x } / &'a' . { y }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := kbd.Choice(
+		kbd.Cap(kbd.Seq(kbd.MustKeys("d"), kbd.Not(kbd.MustKeys("d")), kbd.AnyRune()), "x"),
+		kbd.Cap(kbd.Seq(kbd.And(kbd.MustKeys("a")), kbd.AnyRune()), "y"),
+	)
+	same(t, p, expect)
+}
+
+func TestNamed(t *testing.T) {
+	p, err := Compile("test", `$count:.+ $dir:('j' / 'k') { move -n $count $dir }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := kbd.Cap(kbd.Seq(
+		kbd.Named("count", kbd.Plus(kbd.AnyRune())),
+		kbd.Named("dir", kbd.Choice(kbd.MustKeys("j"), kbd.MustKeys("k"))),
+	), "move -n $count $dir")
+	same(t, p, expect)
+
+	// a colon in an action does not make a named capture
+	p, err = Compile("test", `'x' { foo:bar }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same(t, p, kbd.Cap(kbd.MustKeys("x"), "foo:bar"))
+}
+
+func TestCompileGrammars(t *testing.T) {
+	for _, file := range []string{"micro.kbd", "vim-normal.kbd", "vim-insert.kbd", "vim-visual.kbd"} {
+		t.Run(file, func(t *testing.T) {
+			data, err := os.ReadFile("../grammars/" + file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, warnings, err := CompileWarnings(file, string(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range warnings {
+				t.Error(w)
+			}
+			if err := CheckActions(file, string(data)); err != nil {
+				t.Error(err)
+			}
+			if _, err := kbd.Compile(p); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestGolden checks that each grammar compiles to the program stored in
+// testdata. Run with -update to regenerate the golden files.
+func TestGolden(t *testing.T) {
+	for _, file := range []string{"micro.kbd", "vim-normal.kbd", "vim-insert.kbd", "vim-visual.kbd"} {
+		t.Run(file, func(t *testing.T) {
+			data, err := os.ReadFile("../grammars/" + file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog, err := kbd.Compile(MustCompile(file, string(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", strings.TrimSuffix(file, ".kbd")+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(prog.String()), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expect, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prog.String() != string(expect) {
+				t.Fatalf("program for %s does not match %s", file, golden)
+			}
+		})
+	}
+}
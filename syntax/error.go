@@ -0,0 +1,92 @@
+package syntax
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zyedidia/kbd"
+)
+
+// An Error describes a problem at a specific position of a grammar file.
+type Error struct {
+	Name string // name of the grammar file
+	Line int    // line number, starting at 1
+	Col  int    // column number in runes, starting at 1
+	Msg  string
+	Text string // the line containing the error
+}
+
+// newError returns an error at byte offset 'pos' of the grammar 's'.
+func newError(name, s string, pos int, format string, args ...interface{}) *Error {
+	if pos > len(s) {
+		pos = len(s)
+	}
+	start := strings.LastIndexByte(s[:pos], '\n') + 1
+	end := strings.IndexByte(s[pos:], '\n')
+	if end < 0 {
+		end = len(s)
+	} else {
+		end += pos
+	}
+	p := position(name, s, pos)
+	return &Error{
+		Name: name,
+		Line: p.Line,
+		Col:  p.Col,
+		Msg:  fmt.Sprintf(format, args...),
+		Text: strings.TrimRight(s[start:end], "\r"),
+	}
+}
+
+// position returns the line and column of byte offset 'pos' of the grammar 's'.
+func position(name, s string, pos int) kbd.Pos {
+	if pos > len(s) {
+		pos = len(s)
+	}
+	start := strings.LastIndexByte(s[:pos], '\n') + 1
+	return kbd.Pos{
+		Name: name,
+		Line: strings.Count(s[:pos], "\n") + 1,
+		Col:  utf8.RuneCountInString(s[start:pos]) + 1,
+	}
+}
+
+// Error returns the message prefixed with the position, followed by the
+// offending line and a caret pointing at the column.
+func (e *Error) Error() string {
+	// keep tabs so the caret lines up with the excerpt
+	pad := make([]rune, 0, e.Col-1)
+	for i, r := range []rune(e.Text) {
+		if i >= e.Col-1 {
+			break
+		}
+		if r == '\t' {
+			pad = append(pad, '\t')
+		} else {
+			pad = append(pad, ' ')
+		}
+	}
+	return fmt.Sprintf("%s:%d:%d: %s\n%s\n%s^", e.Name, e.Line, e.Col, e.Msg, e.Text, string(pad))
+}
+
+// An ErrorList is a list of errors sorted by position.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, 0, len(l))
+	for _, e := range l {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (l ErrorList) sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		if l[i].Line != l[j].Line {
+			return l[i].Line < l[j].Line
+		}
+		return l[i].Col < l[j].Col
+	})
+}
@@ -0,0 +1,155 @@
+package syntax
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/zyedidia/kbd"
+	"github.com/zyedidia/kbd/action"
+)
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		grammar string
+		expect  string
+	}{
+		{
+			"bindings <- 'a' { x }\n         / 'b<foo>' { y }\n",
+			"test.kbd:2:14: invalid key \"<foo>\"\n         / 'b<foo>' { y }\n             ^",
+		},
+		{
+			"bindings <- 'ctrl-foo' { x }",
+			"test.kbd:1:14: unknown key name \"ctrl-foo\"\nbindings <- 'ctrl-foo' { x }\n             ^",
+		},
+		{
+			"bindings <- 'a' { x }\n\t/ 'b { y }\n",
+			"test.kbd:2:4: unterminated literal\n\t/ 'b { y }\n\t  ^",
+		},
+		{
+			"bindings <- 'a' { x\n",
+			"test.kbd:1:17: unterminated action\nbindings <- 'a' { x\n                ^",
+		},
+		{
+			"bindings <- 'a' ) { x }",
+			"test.kbd:1:17: unexpected ')'\nbindings <- 'a' ) { x }\n                ^",
+		},
+		{
+			"bindings <- a\na <- 'a' { x }\na <- 'b' { y }\n",
+			"test.kbd:3:1: rule \"a\" is already defined\na <- 'b' { y }\n^",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expect, func(t *testing.T) {
+			_, err := Compile("test.kbd", tt.grammar)
+			var serr *Error
+			if !errors.As(err, &serr) {
+				t.Fatalf("expected a syntax error, got %v", err)
+			}
+			if err.Error() != tt.expect {
+				t.Fatalf("got:\n%s\nexpected:\n%s", err, tt.expect)
+			}
+		})
+	}
+}
+
+func TestActionErrors(t *testing.T) {
+	tests := []struct {
+		grammar string
+		expect  string
+	}{
+		{
+			"bindings <- 'a' { insert 'x }",
+			"test.kbd:1:26: unterminated string\nbindings <- 'a' { insert 'x }\n                         ^",
+		},
+		{
+			"bindings <- { 'a', 'quit]' }",
+			"test.kbd:1:25: unexpected ']'\nbindings <- { 'a', 'quit]' }\n                        ^",
+		},
+		{
+			"bindings <- 'a' {\n  cursor-to [find\n}",
+			"test.kbd:2:13: unterminated substitution\n  cursor-to [find\n            ^",
+		},
+		{
+			"bindings <- 'a' { quit] }\n         / 'b' { cursor-to [find }\n",
+			"test.kbd:1:23: unexpected ']'\nbindings <- 'a' { quit] }\n                      ^\n" +
+				"test.kbd:2:28: unterminated substitution\n         / 'b' { cursor-to [find }\n                           ^",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expect, func(t *testing.T) {
+			// actions in other languages are not checked by Compile
+			if _, err := Compile("test.kbd", tt.grammar); err != nil {
+				t.Fatal(err)
+			}
+			err := CheckActions("test.kbd", tt.grammar)
+			if err == nil || err.Error() != tt.expect {
+				t.Fatalf("got:\n%v\nexpected:\n%s", err, tt.expect)
+			}
+		})
+	}
+
+	if err := CheckActions("test.kbd", "bindings <- 'a' { insert [x] $1 }\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUndefinedRules(t *testing.T) {
+	_, err := Compile("test.kbd", "bindings <- 'a' <Move> { x }\n         / Other\n")
+	expect := "test.kbd:1:18: undefined rule \"Move\"\n" +
+		"bindings <- 'a' <Move> { x }\n" +
+		"                 ^\n" +
+		"test.kbd:2:12: undefined rule \"Other\"\n" +
+		"         / Other\n" +
+		"           ^"
+	if err == nil || err.Error() != expect {
+		t.Fatalf("got:\n%v\nexpected:\n%s", err, expect)
+	}
+
+	_, err = Compile("test.kbd", "main <- 'a'\n")
+	if err == nil || err.Error() != "test.kbd:1:1: missing root rule \"bindings\"\nmain <- 'a'\n^" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestUnreachableRules(t *testing.T) {
+	_, warnings, err := CompileWarnings("test.kbd", "bindings <- 'a' { x }\nUnused <- 'b' { y }\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Error() != "test.kbd:2:1: rule \"Unused\" is never used\nUnused <- 'b' { y }\n^" {
+		t.Fatalf("got %v", warnings)
+	}
+}
+
+func TestCheckActions(t *testing.T) {
+	grammar := "bindings <- 'a' { cursor-rigth }\n" +
+		"          / { 'b', 'insert [cursor-right] x' }\n" +
+		"          / { 'd', 'insert \\'a\\'; [cursor-rigth]' }\n" +
+		"          / 'c' {\n" +
+		"              cursor-right 3\n" +
+		"          }\n"
+	p, err := Compile("test.kbd", grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := action.NewRegistry(
+		action.Spec{Name: "cursor-right"},
+		action.Spec{Name: "insert", Args: []action.Type{action.Any}},
+	)
+	var errs []string
+	for _, err := range reg.Check(kbd.MustCompile(p)) {
+		errs = append(errs, err.Error())
+	}
+	expect := []string{
+		`test.kbd:1:19: unknown command "cursor-rigth"`,
+		"test.kbd:2:21: insert takes 1 argument, got 2",
+		`test.kbd:3:36: unknown command "cursor-rigth"`,
+		"test.kbd:5:15: cursor-right takes 0 arguments, got 1",
+	}
+	if !reflect.DeepEqual(errs, expect) {
+		t.Fatalf("got %q, expected %q", errs, expect)
+	}
+}
@@ -5,20 +5,28 @@ import (
 	p "github.com/zyedidia/gpeg/pattern"
 )
 
-// Pattern    <- Spacing_ (Grammar / Expression) EndOfFile_
+// Pattern    <- Spacing_ (Grammar / Expression) (EndOfFile_ / ERROR)
 // Grammar    <- Definition+
 // Definition <- Identifier LEFTARROW Expression
 //
-// Expression <- Sequence (SLASH Sequence)*
-// Sequence   <- Prefix*
+// Expression <- Alternation (SLASH Alternation)*
+// Alternation <- Sequence (BAR Sequence)*
+// Sequence   <- Prefix* Action?
 // Prefix     <- (AND / NOT)? Suffix
 // Suffix     <- Primary (QUESTION / STAR / PLUS)?
-// Primary    <- BRACEO Expression COMMA String BRACEC
+// Primary    <- BRACEO Expression COMMA (Literal / ActionBody) BRACEC
+//             / DOLLAR Identifier COLON Suffix
+//             / LANGLE Identifier RANGLE
 //             / Identifier !LEFTARROW
 //             / '(' Expression ')'
 //             / Literal / Class
 //             / DOT
 //
+// Action     <- '{' Spacing_ ActionBody '}' Spacing_
+// ActionBody <- ('{' ActionBody '}' / ActionStr / !'}' .)*
+// ActionStr  <- ['] ('\\' . / !['] .)* [']
+//             / ["] ('\\' . / !["] .)* ["]
+//
 // Identifier <- IdentStart IdentCont* Spacing_
 // IdentStart <- [a-zA-Z_]
 // IdentCont  <- IdentStart / [0-9]
@@ -41,11 +49,16 @@ import (
 // CARAT      <- '^' Spacing_
 // BRACEO     <- '{' Spacing_
 // BRACEC     <- '}' Spacing_
+// LANGLE     <- '<' !'-' Spacing_
+// RANGLE     <- '>' Spacing_
 // LEFTARROW  <- '<-' Spacing_
 // OPEN       <- '(' Spacing_
 // CLOSE      <- ')' Spacing_
 // SLASH      <- '/' Spacing_
+// BAR        <- '|' Spacing_
 // COMMA      <- ',' Spacing_
+// COLON      <- ':' Spacing_
+// DOLLAR     <- '$'
 //
 // Spacing_   <- (Space_ / Comment_)*
 // Comment_   <- '#' (!EndOfLine_ .)* EndOfLine_
@@ -78,6 +91,11 @@ const (
 	idCARAT
 	idOPEN
 	idBRACEO
+	idAction
+	idLANGLE
+	idAlternation
+	idCOLON
+	idDOLLAR
 )
 
 var grammar = map[string]p.Pattern{
@@ -87,7 +105,10 @@ var grammar = map[string]p.Pattern{
 			p.NonTerm("Grammar"),
 			p.NonTerm("Expression"),
 		),
-		p.NonTerm("EndOfFile"),
+		p.Or(
+			p.NonTerm("EndOfFile"),
+			p.Error("syntax error", nil),
+		),
 	), idPattern),
 	"Grammar": p.Cap(p.Plus(p.NonTerm("Definition")), idGrammar),
 	"Definition": p.Cap(p.Concat(
@@ -97,13 +118,30 @@ var grammar = map[string]p.Pattern{
 	), idDefinition),
 
 	"Expression": p.Cap(p.Concat(
-		p.NonTerm("Sequence"),
+		p.NonTerm("Alternation"),
 		p.Star(p.Concat(
 			p.NonTerm("SLASH"),
-			p.NonTerm("Sequence"),
+			p.NonTerm("Alternation"),
 		)),
 	), idExpression),
-	"Sequence": p.Cap(p.Star(p.NonTerm("Suffix")), idSequence),
+	"Alternation": p.Cap(p.Concat(
+		p.NonTerm("Sequence"),
+		p.Star(p.Concat(
+			p.NonTerm("BAR"),
+			p.NonTerm("Sequence"),
+		)),
+	), idAlternation),
+	"Sequence": p.Cap(p.Concat(
+		p.Star(p.NonTerm("Prefix")),
+		p.Optional(p.NonTerm("Action")),
+	), idSequence),
+	"Prefix": p.Cap(p.Concat(
+		p.Optional(p.Or(
+			p.NonTerm("AND"),
+			p.NonTerm("NOT"),
+		)),
+		p.NonTerm("Suffix"),
+	), idPrefix),
 	"Suffix": p.Cap(p.Concat(
 		p.NonTerm("Primary"),
 		p.Optional(p.Or(
@@ -117,8 +155,27 @@ var grammar = map[string]p.Pattern{
 			p.NonTerm("BRACEO"),
 			p.NonTerm("Expression"),
 			p.NonTerm("COMMA"),
-			p.NonTerm("Literal"),
-			p.NonTerm("BRACEC"),
+			p.Or(
+				p.Concat(
+					p.NonTerm("Literal"),
+					p.NonTerm("BRACEC"),
+				),
+				p.Concat(
+					p.Cap(p.NonTerm("ActionBody"), idAction),
+					p.NonTerm("BRACEC"),
+				),
+			),
+		),
+		p.Concat(
+			p.NonTerm("DOLLAR"),
+			p.NonTerm("Identifier"),
+			p.NonTerm("COLON"),
+			p.NonTerm("Suffix"),
+		),
+		p.Concat(
+			p.NonTerm("LANGLE"),
+			p.NonTerm("Identifier"),
+			p.NonTerm("RANGLE"),
 		),
 		p.Concat(
 			p.NonTerm("Identifier"),
@@ -134,6 +191,44 @@ var grammar = map[string]p.Pattern{
 		p.NonTerm("DOT"),
 	), idPrimary),
 
+	"Action": p.Concat(
+		p.Literal("{"),
+		p.NonTerm("Spacing"),
+		p.Cap(p.NonTerm("ActionBody"), idAction),
+		p.Literal("}"),
+		p.NonTerm("Spacing"),
+	),
+	"ActionBody": p.Star(p.Or(
+		p.Concat(
+			p.Literal("{"),
+			p.NonTerm("ActionBody"),
+			p.Literal("}"),
+		),
+		p.NonTerm("ActionStr"),
+		p.Concat(
+			p.Not(p.Literal("}")),
+			p.Any(1),
+		),
+	)),
+	"ActionStr": p.Or(
+		p.Concat(
+			p.Literal("'"),
+			p.Star(p.Or(
+				p.Concat(p.Literal("\\"), p.Any(1)),
+				p.Concat(p.Not(p.Literal("'")), p.Any(1)),
+			)),
+			p.Literal("'"),
+		),
+		p.Concat(
+			p.Literal("\""),
+			p.Star(p.Or(
+				p.Concat(p.Literal("\\"), p.Any(1)),
+				p.Concat(p.Not(p.Literal("\"")), p.Any(1)),
+			)),
+			p.Literal("\""),
+		),
+	),
+
 	"Identifier": p.Cap(p.Concat(
 		p.NonTerm("IdentStart"),
 		p.Star(p.NonTerm("IdentCont")),
@@ -257,6 +352,19 @@ var grammar = map[string]p.Pattern{
 		p.Literal("/"),
 		p.NonTerm("Spacing"),
 	),
+	"BAR": p.Concat(
+		p.Literal("|"),
+		p.NonTerm("Spacing"),
+	),
+	"LANGLE": p.Cap(p.Concat(
+		p.Literal("<"),
+		p.Not(p.Literal("-")),
+		p.NonTerm("Spacing"),
+	), idLANGLE),
+	"RANGLE": p.Concat(
+		p.Literal(">"),
+		p.NonTerm("Spacing"),
+	),
 	"LEFTARROW": p.Concat(
 		p.Literal("<-"),
 		p.NonTerm("Spacing"),
@@ -265,6 +373,11 @@ var grammar = map[string]p.Pattern{
 		p.Literal(","),
 		p.NonTerm("Spacing"),
 	),
+	"COLON": p.Cap(p.Concat(
+		p.Literal(":"),
+		p.NonTerm("Spacing"),
+	), idCOLON),
+	"DOLLAR": p.Cap(p.Literal("$"), idDOLLAR),
 
 	"Spacing": p.Star(p.Or(
 		p.NonTerm("Space"),
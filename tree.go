@@ -0,0 +1,51 @@
+package kbd
+
+// A Node is a capture in the capture tree of an action (see VM.SetTree). It
+// gives the template of the capture and the captures of its arguments, so that
+// a host can bind the variables of the template to the events they refer to
+// without parsing the expanded command (see package action for the commands of
+// the template).
+type Node struct {
+	// Template is the template of the capture before expansion. It is empty
+	// for an argument that did not complete a capture.
+	Template string
+	// Args are the arguments of the capture, which are bound to $1, $2, ...
+	// An argument that did not match is nil.
+	Args []*Node
+	// Named are the arguments of the capture that were given a name (see
+	// Named).
+	Named map[string]*Node
+	// Value is the value of the events matched by the node, as for the Vars of
+	// an Action.
+	Value interface{}
+}
+
+// newNode returns the node of the capture ending with 't'. The arguments are
+// the values marked as arguments if 'positional' is true, or all the values
+// otherwise, as for the expansion of the template.
+func newNode(t iCapEnd, vals []value, positional bool, val interface{}) *Node {
+	n := &Node{
+		Template: t.cmd,
+		Value:    val,
+	}
+	if positional {
+		n.Args = make([]*Node, t.nargs)
+	}
+	for _, v := range vals {
+		if positional && !v.arg {
+			continue
+		}
+		if v.index > 0 {
+			n.Args[v.index-1] = v.node
+		} else {
+			n.Args = append(n.Args, v.node)
+		}
+		if v.name != "" {
+			if n.Named == nil {
+				n.Named = make(map[string]*Node)
+			}
+			n.Named[v.name] = v.node
+		}
+	}
+	return n
+}
@@ -0,0 +1,104 @@
+package kbd
+
+import (
+	"bytes"
+
+	"github.com/micro-editor/tcell/v2"
+)
+
+// A Position is the value of a mouse event.
+type Position struct {
+	X, Y   int
+	Button tcell.ButtonMask
+	Mod    tcell.ModMask
+}
+
+// A Size is the value of a resize event.
+type Size struct {
+	W, H int
+}
+
+// Events is the value of a capture of zero or several events.
+type Events []tcell.Event
+
+// Text returns the runes and pasted text of the events.
+func (evs Events) Text() string {
+	buf := &bytes.Buffer{}
+	for _, ev := range evs {
+		switch ev := ev.(type) {
+		case *tcell.EventKey:
+			if ev.Key() == tcell.KeyRune {
+				buf.WriteRune(ev.Rune())
+			}
+		case *tcell.EventPaste:
+			buf.WriteString(ev.Text())
+		}
+	}
+	return buf.String()
+}
+
+// textual returns true if the events are all runes and pastes, so that Text
+// loses nothing.
+func (evs Events) textual() bool {
+	for _, ev := range evs {
+		switch ev := ev.(type) {
+		case *tcell.EventKey:
+			if ev.Key() != tcell.KeyRune {
+				return false
+			}
+		case *tcell.EventPaste:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the events separated by spaces and surrounded by braces.
+func (evs Events) String() string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, ev := range evs {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(ev2str(ev))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// value returns the value of the events from start to end (see Action).
+func (evs events) value(start, end int) interface{} {
+	if end-start == 1 {
+		return eventValue(evs[start])
+	}
+	// copy the events since the VM reuses its buffer
+	return append(Events(nil), evs[start:end]...)
+}
+
+func eventValue(ev tcell.Event) interface{} {
+	switch ev := ev.(type) {
+	case *tcell.EventKey:
+		if ev.Key() == tcell.KeyRune {
+			return ev.Rune()
+		}
+	case *tcell.EventMouse:
+		x, y := ev.Position()
+		return Position{
+			X:      x,
+			Y:      y,
+			Button: ev.Buttons(),
+			Mod:    ev.Modifiers(),
+		}
+	case *tcell.EventPaste:
+		return ev.Text()
+	case *tcell.EventResize:
+		w, h := ev.Size()
+		return Size{
+			W: w,
+			H: h,
+		}
+	}
+	return ev
+}
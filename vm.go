@@ -1,8 +1,8 @@
 package kbd
 
 import (
-	"bytes"
 	"fmt"
+	"time"
 
 	"github.com/micro-editor/tcell/v2"
 )
@@ -26,55 +26,199 @@ func ev2str(ev tcell.Event) string {
 	return ""
 }
 
-func (evs events) slice(start, end int) string {
-	if start >= end {
-		return ""
-	}
+// A Policy decides which match is returned when several machines finish
+// matching after the same event.
+type Policy int
 
-	buf := &bytes.Buffer{}
-	slc := evs[start:end]
-	for i, e := range slc {
-		buf.WriteString(ev2str(e))
-		if i < len(slc)-1 {
-			buf.WriteByte(' ')
-		}
-	}
-	if end-start > 1 {
-		return fmt.Sprintf("{%s}", buf.String())
-	}
-	return buf.String()
-}
+const (
+	// FirstMatch returns the match that took the earliest alternative in the
+	// source, as if the alternatives were tried in order.
+	FirstMatch Policy = iota
+	// LongestMatch returns the match that consumed the most events. Matches of
+	// the same length are ordered as with FirstMatch.
+	LongestMatch
+)
 
+// A VM is a session running a program over one stream of events. All of the
+// state of the matching lives in the VM, so each goroutine can run its own
+// session of a shared Program, but a VM must only be used by one goroutine at
+// a time.
 type VM struct {
 	// program to be executed
 	prog Program
-	// separate machines executing each program path
+	// how to choose between simultaneous matches
+	policy Policy
+	// how the values of variables are quoted when actions are expanded
+	quoting Quoting
+	// maximum number of running machines, or 0 for no limit
+	max int
+	// separate machines executing each program path, in priority order. The
+	// machines that finished matching stay in the list, so that their
+	// priority is known, until their action is returned or dropped
 	machines []*machine
+	// recycled machines
+	pool *pool
+	// states reached by the machines during the current event
+	seen map[state]bool
 
 	// all events seen so far
 	evs events
+	// actions that were completed but not returned yet
+	queue []Action
+	// number of events consumed by the last action returned from evs
+	matched int
+	// events to be fed again to a fresh run, the next one last
+	refeed events
+	// whether actions record the spans of their variables, for a DFA
+	spans bool
+	// events that did not belong to any match
+	discarded events
+
+	// how long to wait for the next event before giving up on longer
+	// matches, or 0 to wait forever
+	timeout time.Duration
+	// clock used to measure the timeout
+	now func() time.Time
+	// time the last event was received
+	last time.Time
 }
 
+// NewVM returns a new session running 'prog'. Creating a session is cheap.
 func NewVM(prog Program) *VM {
+	pool := newPool()
 	return &VM{
 		prog:     prog,
-		machines: []*machine{newMachine()},
+		machines: []*machine{pool.get()},
+		pool:     pool,
+		seen:     make(map[state]bool),
+		now:      time.Now,
+		max:      DefaultMaxMachines,
+	}
+}
+
+// DefaultMaxMachines is the default limit on the number of machines that a VM
+// runs at the same time.
+const DefaultMaxMachines = 1024
+
+// SetMaxMachines limits the number of machines that run at the same time.
+// When there are more, the ones with the lowest priority are dropped. A limit
+// of 0 disables this.
+func (vm *VM) SetMaxMachines(max int) {
+	vm.max = max
+}
+
+// SetPolicy sets how the VM chooses between matches that complete on the same
+// event. The default is FirstMatch. The policy belongs to the session rather
+// than to the Program, so a host that uses a different policy for each grammar
+// sets it on the VM that runs each one.
+func (vm *VM) SetPolicy(policy Policy) {
+	vm.policy = policy
+}
+
+// SetQuoting sets the quoting rules of the language of the program's actions,
+// which are used to quote the values of variables when an action is expanded.
+// The default is ActionQuoting.
+func (vm *VM) SetQuoting(quoting Quoting) {
+	vm.quoting = quoting
+}
+
+// SetTree sets whether the actions include the tree of their captures. Trees
+// are not built by default, since building them allocates for every capture.
+func (vm *VM) SetTree(tree bool) {
+	vm.pool.tree = tree
+}
+
+// SetTimeout sets how long the VM waits for the next event when the events so
+// far are a prefix of a longer binding. Once the timeout has elapsed, Tick
+// returns the best match found so far, like vim's 'timeoutlen'. A timeout of 0
+// disables this, which is the default.
+func (vm *VM) SetTimeout(timeout time.Duration) {
+	vm.timeout = timeout
+}
+
+// SetClock sets the function used to get the current time, which defaults to
+// time.Now.
+func (vm *VM) SetClock(now func() time.Time) {
+	vm.now = now
+}
+
+// Deadline returns the time at which Tick will give up waiting for more
+// events. It returns false if there is no timeout or nothing is pending.
+func (vm *VM) Deadline() (time.Time, bool) {
+	if vm.timeout <= 0 || !vm.pending() {
+		return time.Time{}, false
+	}
+	return vm.last.Add(vm.timeout), true
+}
+
+// Tick checks whether the timeout has elapsed since the last event. If it has,
+// the machines that are still waiting for events are abandoned and the best
+// match found so far, if any, is returned. The return values have the same
+// meaning as for Exec.
+func (vm *VM) Tick() (action Action, ok bool, more bool) {
+	deadline, pending := vm.Deadline()
+	if !pending || vm.now().Before(deadline) {
+		return action, false, vm.pending()
+	}
+
+	vm.drop(func(m *machine) bool {
+		return !m.status.done
+	})
+	vm.accept()
+	if !vm.pending() {
+		vm.recover()
+	}
+	vm.drain()
+	action, ok = vm.Next()
+	return action, ok, vm.pending()
+}
+
+// Next returns the next action completed by the last call to Exec or Tick. In
+// LongestMatch mode a single event can complete several actions: Exec returns
+// the first one and the others must be retrieved with Next before calling
+// Reset.
+func (vm *VM) Next() (Action, bool) {
+	if len(vm.queue) == 0 {
+		return Action{}, false
 	}
+	action := vm.queue[0]
+	// shift rather than reslice so that the queue keeps its capacity
+	copy(vm.queue, vm.queue[1:])
+	vm.queue[len(vm.queue)-1] = Action{}
+	vm.queue = vm.queue[:len(vm.queue)-1]
+	return action, true
 }
 
+// Reset abandons the events seen so far. The memory used by the VM is kept
+// for the next events.
 func (vm *VM) Reset() {
-	vm.machines = []*machine{newMachine()}
-	vm.evs = nil
+	vm.pool.put(vm.machines...)
+	vm.pool.forget()
+	vm.machines = append(vm.machines[:0], vm.pool.get())
+	vm.evs = vm.evs[:0]
+	vm.queue = vm.queue[:0]
+	vm.matched = 0
+	vm.discarded = nil
 }
 
-// vm is blocked if all submachines are blocked
-func (vm *VM) blocked() bool {
-	for _, m := range vm.machines {
-		if !m.status.blocked {
-			return false
-		}
+// duplicate returns true if a machine in the same state as m was already seen.
+// Only splits and consumes are checked, since every loop goes through a split
+// and machines that converge meet again at the next consume.
+func (vm *VM) duplicate(m *machine) bool {
+	if m.pc < 0 || m.pc >= len(vm.prog) {
+		return false
+	}
+	switch vm.prog[m.pc].(type) {
+	case iSplit, iChoice, iConsume:
+	default:
+		return false
 	}
-	return true
+	key := m.state()
+	if vm.seen[key] {
+		return true
+	}
+	vm.seen[key] = true
+	return false
 }
 
 func (vm *VM) unblock() {
@@ -83,46 +227,366 @@ func (vm *VM) unblock() {
 	}
 }
 
+// An Action is the result of a match. Cmd is the expanded template of the
+// outermost capture, in which the events referred to by $0 or by arguments are
+// replaced by variable references $0, $1, ... into Vars. A variable holds the
+// value of the events it refers to: a rune for a rune key, a Position for a
+// mouse event, the text of a paste, the Size of a resize, the tcell event for
+// any other key, and Events for zero or several events. Other names, such as
+// $pos, are variables of the host that are left in Cmd, to be resolved by
+// Expand. $$ in the templates is a dollar sign in Cmd. Quoting is the quoting
+// of the VM that produced the action (see SetQuoting). Tree is the capture
+// tree of the outermost capture if the VM builds trees (see SetTree).
 type Action struct {
-	Cmd  string
-	Vars []interface{}
+	Cmd     string
+	Vars    []interface{}
+	Quoting Quoting
+	Tree    *Node
+
+	// Cmd with $$ kept for the dollar signs that are not variables
+	raw string
+	// positions of the events of Vars in the current run, if the VM records
+	// them for a DFA
+	spans []span
 }
 
 // Exec consumes the next event. It returns three values: 'more' indicates that
 // there may be more commands in the future if more events are given; 'ok'
 // indicates that there is a command to execute now, 'action' is the command to
 // execute now if 'ok' is true.
+//
+// A match is returned as soon as it is found, unless it lost a prioritized
+// choice (see Choice) to a machine that is still running. In that case it is
+// held until the preferred machines fail, and is dropped if one of them
+// matches. When several matches are found after the same event, the one
+// returned is chosen by the VM's policy (see SetPolicy).
+//
+// In LongestMatch mode every match is held while a machine that could match
+// more events is still running. Once they have all failed or finished the best
+// match is returned, and the events that follow it are fed to a fresh run,
+// which may complete more actions (see Next).
 func (vm *VM) Exec(next tcell.Event) (action Action, ok bool, more bool) {
+	vm.feed(next)
+	action, ok = vm.Next()
+	return action, ok, vm.pending()
+}
+
+// feed consumes the next event and queues the actions it completes.
+func (vm *VM) feed(next tcell.Event) {
+	vm.last = vm.now()
+	vm.run(next)
+	vm.drain()
+}
+
+// drain feeds the events that were queued to be fed again, in order. Each one
+// is fed with run rather than by restarting recursively, so that an event
+// that is discarded does not leave the following ones without a machine.
+func (vm *VM) drain() {
+	for n := len(vm.refeed); n > 0; n = len(vm.refeed) {
+		ev := vm.refeed[n-1]
+		vm.refeed[n-1] = nil
+		vm.refeed = vm.refeed[:n-1]
+		vm.run(ev)
+	}
+}
+
+// run feeds one event to the machines, starting a fresh run first if every
+// machine has failed or finished.
+func (vm *VM) run(next tcell.Event) {
+	if !vm.pending() {
+		vm.fresh()
+	}
 	vm.evs = append(vm.evs, next)
 
-	for {
-		for i := 0; i < len(vm.machines); i++ {
-			m := vm.machines[i]
-			if m.status.blocked {
+	// Run each machine until it blocks or finishes, in priority order: forks
+	// are inserted right after their parent, so the machines stay sorted.
+	// Like in a Pike VM, a machine that reaches a state that a machine with a
+	// higher priority already reached is dropped, which also stops loops that
+	// do not consume events.
+	for k := range vm.seen {
+		delete(vm.seen, k)
+	}
+	for i := 0; i < len(vm.machines); i++ {
+		m := vm.machines[i]
+		for !m.status.blocked && !m.status.done {
+			if vm.duplicate(m) {
+				m.done(false)
 				continue
 			}
-			pc, split := m.step(vm.prog, vm.evs)
-			if split {
-				vm.machines = append(vm.machines, m.cpy(pc))
-			}
-			if m.status.done {
-				// slice tricks delete
-				ln := len(vm.machines)
-				vm.machines[i] = vm.machines[ln-1]
-				vm.machines[ln-1] = nil
-				vm.machines = vm.machines[:ln-1]
-				i--
-				if !m.status.failed && !ok {
-					action.Cmd = m.cmds[0]
-					action.Vars = m.vars
-					ok = true
-				}
+			if fork := m.step(vm.prog, vm.evs); fork != nil {
+				vm.machines = append(vm.machines, nil)
+				copy(vm.machines[i+2:], vm.machines[i+1:])
+				vm.machines[i+1] = fork
 			}
 		}
-		if len(vm.machines) == 0 || vm.blocked() {
-			break
+		if m.status.failed {
+			// delete preserving the order, which is the priority
+			copy(vm.machines[i:], vm.machines[i+1:])
+			vm.machines[len(vm.machines)-1] = nil
+			vm.machines = vm.machines[:len(vm.machines)-1]
+			i--
+			vm.pool.put(m)
 		}
 	}
+	if vm.max > 0 && len(vm.machines) > vm.max {
+		// keep the running machines with the highest priority
+		n := 0
+		vm.drop(func(m *machine) bool {
+			if !m.status.done {
+				n++
+			}
+			return n > vm.max && !m.status.done
+		})
+	}
 	vm.unblock()
-	return action, ok, len(vm.machines) > 0
+
+	if vm.policy == LongestMatch {
+		vm.prune()
+		if !vm.running() {
+			vm.accept()
+		}
+	} else if m := vm.match(); m != nil {
+		vm.queue = append(vm.queue, vm.emit(m))
+	}
+	if !vm.pending() {
+		vm.recover()
+	}
+}
+
+// prune removes the running machines that lost a prioritized choice to a
+// finished machine, since they can no longer be returned.
+func (vm *VM) prune() {
+	vm.drop(func(o *machine) bool {
+		if o.status.done {
+			return false
+		}
+		for _, m := range vm.machines {
+			if m.status.done && m.preferred(o) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// drop removes the machines for which f returns true, keeping the order of
+// the others.
+func (vm *VM) drop(f func(m *machine) bool) {
+	alive := vm.machines[:0]
+	for _, m := range vm.machines {
+		if f(m) {
+			vm.pool.put(m)
+		} else {
+			alive = append(alive, m)
+		}
+	}
+	for i := len(alive); i < len(vm.machines); i++ {
+		vm.machines[i] = nil
+	}
+	vm.machines = alive
+}
+
+// running returns true if a machine has not finished matching.
+func (vm *VM) running() bool {
+	for _, m := range vm.machines {
+		if !m.status.done {
+			return true
+		}
+	}
+	return false
+}
+
+// accept queues the action of the best finished match and queues the events
+// that follow it to be fed again. It must only be called when no machine is
+// running.
+func (vm *VM) accept() {
+	m := vm.match()
+	if m == nil {
+		return
+	}
+	vm.queue = append(vm.queue, vm.emit(m))
+
+	// an empty match consumes one event anyway, so that the same events are
+	// not fed again forever. That event did not belong to the match, so it is
+	// discarded as in recover
+	start := vm.matched
+	if start == 0 && len(vm.evs) > 0 {
+		vm.discarded = append(vm.discarded, vm.evs[0])
+		start = 1
+	}
+	vm.requeue(start)
+}
+
+// recover is called when every machine has failed. The events that follow the
+// last match are queued to be fed to a fresh run, except for the first one if
+// it does not follow a match, since no binding starts with it. That event is
+// recorded as discarded.
+func (vm *VM) recover() {
+	start := vm.matched
+	if start >= len(vm.evs) {
+		return
+	}
+	if start == 0 {
+		vm.discarded = append(vm.discarded, vm.evs[0])
+		start = 1
+	}
+	vm.requeue(start)
+}
+
+// requeue abandons the machines and queues the events from evs[start:] to be
+// fed again, before the events that were already queued.
+func (vm *VM) requeue(start int) {
+	vm.pool.put(vm.machines...)
+	vm.machines = vm.machines[:0]
+	for i := len(vm.evs) - 1; i >= start; i-- {
+		vm.refeed = append(vm.refeed, vm.evs[i])
+	}
+	// the events before start are done with, so they must not be recovered
+	vm.evs, vm.matched = vm.evs[:start], start
+}
+
+// fresh starts a new run after the events seen so far, which are dropped.
+func (vm *VM) fresh() {
+	vm.pool.put(vm.machines...)
+	vm.pool.forget()
+	vm.machines = append(vm.machines[:0], vm.pool.get())
+	vm.evs = vm.evs[:0]
+	vm.matched = 0
+}
+
+// Discarded returns the events that did not belong to any match since the
+// last call to Discarded or Reset. When every machine fails, the VM drops the
+// first event of the failed attempt and restarts on the ones after it, so that
+// for example "dx" in a vim grammar still runs the binding for "x".
+func (vm *VM) Discarded() []tcell.Event {
+	evs := vm.discarded
+	vm.discarded = nil
+	return evs
+}
+
+// A Hint describes an event that can follow the events seen so far, for
+// example to show the possible continuations of a key sequence.
+type Hint struct {
+	// Event matches the events that can come next.
+	Event Event
+	// Actions are the templates of the captures that the event would be part
+	// of, innermost first.
+	Actions []string
+}
+
+// Pending returns the events that the running machines are waiting for, in
+// the order of the alternatives that lead to them. Machines waiting for the
+// same event are merged into one hint.
+func (vm *VM) Pending() []Hint {
+	var hints []Hint
+	index := make(map[string]int)
+	for _, m := range vm.waiting() {
+		t, ok := vm.prog[m.pc].(iConsume)
+		if !ok {
+			continue
+		}
+		key := t.match.String()
+		i, ok := index[key]
+		if !ok {
+			i = len(hints)
+			index[key] = i
+			hints = append(hints, Hint{
+				Event: t.match,
+			})
+		}
+		for _, cmd := range m.templates(vm.prog) {
+			if !contains(hints[i].Actions, cmd) {
+				hints[i].Actions = append(hints[i].Actions, cmd)
+			}
+		}
+	}
+	return hints
+}
+
+// waiting returns the machines that are blocked on the next event, in
+// priority order.
+func (vm *VM) waiting() []*machine {
+	var ms []*machine
+	for _, m := range vm.machines {
+		if !m.status.done && m.sp == len(vm.evs) && m.pc >= 0 && m.pc < len(vm.prog) {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pending returns true if more events may produce a match.
+func (vm *VM) pending() bool {
+	return len(vm.machines) > 0
+}
+
+// emit returns the action of the finished machine m and discards the matches
+// and machines that can no longer be returned, including m itself.
+func (vm *VM) emit(m *machine) Action {
+	action := Action{
+		Quoting: vm.quoting,
+	}
+	if len(m.vals) > 0 {
+		action.Cmd = unescape(m.vals[0].s)
+		action.raw = m.vals[0].s
+		action.Tree = m.vals[0].node
+	}
+	if len(m.vars) > 0 {
+		action.Vars = make([]interface{}, len(m.vars))
+		for i, s := range m.vars {
+			action.Vars[i] = vm.evs.value(s.start, s.end)
+		}
+		if vm.spans {
+			action.spans = append([]span(nil), m.vars...)
+		}
+	}
+	vm.matched = m.sp
+
+	// machines that lost a prioritized choice to m can no longer win, and
+	// the other matches are dropped along with m
+	vm.drop(func(o *machine) bool {
+		return o != m && (o.status.done || m.preferred(o))
+	})
+	// m is released last since its path is needed until then
+	vm.drop(func(o *machine) bool {
+		return o == m
+	})
+	return action
+}
+
+// match returns the finished machine whose action should be returned now, or
+// nil if every finished machine must wait for a preferred machine.
+// The machines are in priority order, so the first of the best matches is
+// returned.
+func (vm *VM) match() *machine {
+	var best *machine
+	for _, m := range vm.machines {
+		if !m.status.done || vm.outranked(m) {
+			continue
+		}
+		if best == nil || (vm.policy == LongestMatch && m.sp > best.sp) {
+			best = m
+		}
+	}
+	return best
+}
+
+// outranked returns true if another running or finished machine has priority
+// over m.
+func (vm *VM) outranked(m *machine) bool {
+	for _, o := range vm.machines {
+		if o != m && o.preferred(m) {
+			return true
+		}
+	}
+	return false
 }
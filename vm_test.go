@@ -0,0 +1,680 @@
+package kbd
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micro-editor/tcell/v2"
+)
+
+func keys(s string) []tcell.Event {
+	evs := make([]tcell.Event, 0, len(s))
+	for _, r := range s {
+		evs = append(evs, tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+	}
+	return evs
+}
+
+// exec feeds the events to a new VM running 'p' and returns the commands that
+// were produced.
+func exec(p Pattern, evs []tcell.Event) []string {
+	vm := NewVM(MustCompile(p))
+	var cmds []string
+	for _, ev := range evs {
+		action, ok, _ := vm.Exec(ev)
+		if ok {
+			cmds = append(cmds, action.Cmd)
+		}
+	}
+	return cmds
+}
+
+func TestArgs(t *testing.T) {
+	g := Grammar("top", map[string]Pattern{
+		"top": Cap(Seq(NonTerm("x"), Arg(NonTerm("a")), Arg(NonTerm("b"))), "$2 $1"),
+		"x":   Cap(MustLit("x"), "ignored"),
+		"a":   Cap(MustLit("a"), "A"),
+		"b":   MustLit("b"),
+	})
+
+	cmds := exec(Seq(g, End()), keys("xab"))
+	if len(cmds) != 1 {
+		t.Fatalf("got %d commands, expected 1", len(cmds))
+	}
+	if cmds[0] != "$0 A" {
+		t.Fatalf("got %q, expected %q", cmds[0], "$0 A")
+	}
+}
+
+func TestPositional(t *testing.T) {
+	p := Cap(Seq(Cap(MustLit("a"), "A"), Cap(MustLit("b"), "B")), "$2 $1")
+
+	cmds := exec(Seq(p, End()), keys("ab"))
+	if len(cmds) != 1 || cmds[0] != "B A" {
+		t.Fatalf("got %q, expected %q", cmds, "B A")
+	}
+
+	// an argument that did not match does not shift the next ones
+	num := Cap(Plus(RangeRune('0', '9')), "5")
+	p = Cap(Seq(Opt(Arg(num)), Arg(Cap(MustKeys("j"), "down"))), "move -n $1 $2")
+	cmds = exec(Seq(p, End()), keys("j"))
+	if len(cmds) != 1 || cmds[0] != "move -n  down" {
+		t.Fatalf("got %q, expected %q", cmds, "move -n  down")
+	}
+}
+
+func TestNamed(t *testing.T) {
+	num := Cap(Plus(RangeRune('0', '9')), "$0")
+	p := Cap(Seq(Opt(Named("count", num)), Named("dir", Cap(MustKeys("j"), "down"))), "$dir -n $count")
+
+	vm := NewVM(MustCompile(Seq(p, End())))
+	var cmds []string
+	for _, input := range []string{"12j", "j"} {
+		vm.Reset()
+		for _, ev := range keys(input) {
+			if action, ok, _ := vm.Exec(ev); ok {
+				cmd, err := action.Expand(nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cmds = append(cmds, cmd)
+			}
+		}
+	}
+	expect := []string{"down -n 12", "down -n "}
+	if !reflect.DeepEqual(cmds, expect) {
+		t.Fatalf("got %q, expected %q", cmds, expect)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	p := Alt(
+		Cap(MustKeys("ZZ"), "save; quit"),
+		Cap(MustKeys("ZQ"), "quit"),
+	)
+
+	cmds := exec(Seq(p, End()), keys("ZQ"))
+	if len(cmds) != 1 || cmds[0] != "quit" {
+		t.Fatalf("got %q, expected %q", cmds, "quit")
+	}
+}
+
+func TestChoice(t *testing.T) {
+	tests := []struct {
+		name   string
+		p      Pattern
+		input  string
+		expect []string
+	}{
+		{"alt first", Alt(Cap(MustKeys("gg"), "a"), Cap(MustKeys("g"), "b")), "g", []string{"b"}},
+		{"choice held", Choice(Cap(MustKeys("gg"), "a"), Cap(MustKeys("g"), "b")), "gg", []string{"a"}},
+		{"choice released", Choice(Cap(MustKeys("gg"), "a"), Cap(MustKeys("g"), "b")), "gx", []string{"b"}},
+		{"choice cut", Choice(Cap(MustKeys("g"), "b"), Cap(MustKeys("gg"), "a")), "gg", []string{"b", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds := exec(Seq(tt.p, End()), keys(tt.input))
+			if len(cmds) != len(tt.expect) {
+				t.Fatalf("got %q, expected %q", cmds, tt.expect)
+			}
+			for i := range cmds {
+				if cmds[i] != tt.expect[i] {
+					t.Fatalf("got %q, expected %q", cmds, tt.expect)
+				}
+			}
+		})
+	}
+
+	vm := NewVM(MustCompile(Seq(Choice(Cap(MustKeys("gg"), "a"), Cap(MustKeys("g"), "b")), End())))
+	if _, ok, more := vm.Exec(keys("g")[0]); ok || !more {
+		t.Fatalf("got ok=%v more=%v, expected a held match", ok, more)
+	}
+}
+
+func TestPredicates(t *testing.T) {
+	tests := []struct {
+		name   string
+		p      Pattern
+		input  string
+		expect []string
+	}{
+		{"not match", Cap(Seq(MustKeys("d"), Not(MustKeys("d")), AnyRune()), "x"), "dx", []string{"x"}},
+		{"not fail", Cap(Seq(MustKeys("d"), Not(MustKeys("d")), AnyRune()), "x"), "dd", nil},
+		{"and match", Cap(Seq(And(MustKeys("ab")), MustKeys("a")), "a"), "ab", []string{"a"}},
+		{"and fail", Cap(Seq(And(MustKeys("ab")), MustKeys("a")), "a"), "ac", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds := exec(Seq(tt.p, End()), keys(tt.input))
+			if len(cmds) != len(tt.expect) {
+				t.Fatalf("got %q, expected %q", cmds, tt.expect)
+			}
+			for i := range cmds {
+				if cmds[i] != tt.expect[i] {
+					t.Fatalf("got %q, expected %q", cmds, tt.expect)
+				}
+			}
+		})
+	}
+
+	// the predicate needs two events before it can be decided
+	vm := NewVM(MustCompile(Seq(Cap(Seq(And(MustKeys("ab")), MustKeys("a")), "a"), End())))
+	if _, ok, more := vm.Exec(keys("a")[0]); ok || !more {
+		t.Fatalf("got ok=%v more=%v, expected the predicate to block", ok, more)
+	}
+	if action, ok, _ := vm.Exec(keys("b")[0]); !ok || action.Cmd != "a" {
+		t.Fatalf("got ok=%v cmd=%q, expected a match", ok, action.Cmd)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	move := Alt(Cap(MustKeys("w"), "word"), Cap(MustKeys("d"), "down"))
+	tests := []struct {
+		name   string
+		policy Policy
+		p      Pattern
+		input  string
+		expect []string
+	}{
+		{"first", FirstMatch, Alt(Cap(Seq(MustKeys("d"), move), "move"), Cap(MustKeys("dd"), "line")), "dd", []string{"move"}},
+		{"first reversed", FirstMatch, Alt(Cap(MustKeys("dd"), "line"), Cap(Seq(MustKeys("d"), move), "move")), "dd", []string{"line"}},
+		{"first empty", FirstMatch, Alt(Cap(Opt(MustKeys("x")), "empty"), Cap(MustKeys("a"), "a")), "a", []string{"empty"}},
+		{"longest", LongestMatch, Alt(Cap(Opt(MustKeys("x")), "empty"), Cap(MustKeys("a"), "a")), "a", []string{"a"}},
+		{"longest tie", LongestMatch, Alt(Cap(MustKeys("dd"), "line"), Cap(Seq(MustKeys("d"), move), "move")), "dd", []string{"line"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewVM(MustCompile(Seq(tt.p, End())))
+			vm.SetPolicy(tt.policy)
+			var cmds []string
+			for _, ev := range keys(tt.input) {
+				if action, ok, _ := vm.Exec(ev); ok {
+					cmds = append(cmds, action.Cmd)
+				}
+			}
+			if !reflect.DeepEqual(cmds, tt.expect) {
+				t.Fatalf("got %q, expected %q", cmds, tt.expect)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	now := time.Unix(0, 0)
+	vm := NewVM(MustCompile(Seq(Choice(Cap(MustKeys("gg"), "top"), Cap(MustKeys("g"), "go")), End())))
+	vm.SetTimeout(time.Second)
+	vm.SetClock(func() time.Time {
+		return now
+	})
+
+	if _, ok, more := vm.Exec(keys("g")[0]); ok || !more {
+		t.Fatalf("got ok=%v more=%v, expected a held match", ok, more)
+	}
+	if deadline, ok := vm.Deadline(); !ok || !deadline.Equal(now.Add(time.Second)) {
+		t.Fatalf("got deadline %v %v", deadline, ok)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if _, ok, more := vm.Tick(); ok || !more {
+		t.Fatalf("got ok=%v more=%v before the timeout", ok, more)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	action, ok, more := vm.Tick()
+	if !ok || more || action.Cmd != "go" {
+		t.Fatalf("got cmd=%q ok=%v more=%v, expected the held match", action.Cmd, ok, more)
+	}
+	if _, ok := vm.Deadline(); ok {
+		t.Fatal("expected no deadline after the timeout")
+	}
+
+	// without a completed match the pending prefix is abandoned
+	vm = NewVM(MustCompile(Seq(Cap(MustKeys("gg"), "top"), End())))
+	vm.SetTimeout(time.Second)
+	vm.SetClock(func() time.Time {
+		return now
+	})
+	vm.Exec(keys("g")[0])
+	now = now.Add(time.Second)
+	if _, ok, more := vm.Tick(); ok || more {
+		t.Fatalf("got ok=%v more=%v, expected the prefix to be abandoned", ok, more)
+	}
+}
+
+func TestPending(t *testing.T) {
+	move := Alt(Cap(MustKeys("w"), "word"), Cap(MustKeys("j"), "down"))
+	g := Rules("top",
+		Rule{"top", Alt(
+			Cap(Seq(MustKeys("d"), Arg(NonTerm("move"))), "delete $1"),
+			Cap(MustKeys("dd"), "delete-line"),
+			Cap(MustKeys("x"), "delete-char"),
+		)},
+		Rule{"move", move},
+	)
+	vm := NewVM(MustCompile(Seq(g, End())))
+	vm.Exec(keys("d")[0])
+
+	type hint struct {
+		Event   string
+		Actions []string
+	}
+	var got []hint
+	for _, h := range vm.Pending() {
+		got = append(got, hint{h.Event.String(), h.Actions})
+	}
+	expect := []hint{
+		{"w", []string{"word", "delete $1"}},
+		{"j", []string{"down", "delete $1"}},
+		{"d", []string{"delete-line"}},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("got %v, expected %v", got, expect)
+	}
+}
+
+func TestLongestMatch(t *testing.T) {
+	digit := RangeRune('0', '9')
+	tests := []struct {
+		name   string
+		p      Pattern
+		input  string
+		expect []string
+	}{
+		{"held", Alt(Cap(MustKeys("ab"), "AB"), Cap(MustKeys("a"), "A")), "ab", []string{"AB"}},
+		{"refeed", Alt(Cap(MustKeys("ab"), "AB"), Cap(MustKeys("a"), "A"), Cap(MustKeys("c"), "C")), "ac", []string{"A", "C"}},
+		{"refeed twice", Alt(Cap(MustKeys("abc"), "ABC"), Cap(MustKeys("a"), "A"), Cap(MustKeys("b"), "B")), "abx", []string{"A", "B"}},
+		{"count", Alt(Cap(Seq(Plus(digit), MustKeys("G")), "goto $0"), Cap(digit, "digit $0")), "12G", []string{"goto {1 2 G}"}},
+		{"count dropped", Alt(Cap(Seq(Plus(digit), MustKeys("G")), "goto"), Cap(digit, "digit $0")), "12x", []string{"digit 1", "digit 2"}},
+		{"choice cut", Choice(Cap(MustKeys("g"), "g"), Cap(MustKeys("gg"), "gg")), "gg", []string{"g", "g"}},
+		{"discard in leftover", Alt(Cap(MustKeys("abcd"), "ABCD"), Cap(MustKeys("a"), "A"), Cap(MustKeys("c"), "C")), "abce", []string{"A", "C"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewVM(MustCompile(Seq(tt.p, End())))
+			vm.SetPolicy(LongestMatch)
+			var cmds []string
+			for _, ev := range keys(tt.input) {
+				action, ok, more := vm.Exec(ev)
+				for ok {
+					cmds = append(cmds, expandVars(action))
+					action, ok = vm.Next()
+				}
+				if !more {
+					vm.Reset()
+				}
+			}
+			if !reflect.DeepEqual(cmds, tt.expect) {
+				t.Fatalf("got %q, expected %q", cmds, tt.expect)
+			}
+		})
+	}
+}
+
+// expandVars replaces the variable references in the action's command with
+// their values.
+func expandVars(action Action) string {
+	cmd := action.Cmd
+	for i := len(action.Vars) - 1; i >= 0; i-- {
+		v := fmt.Sprint(action.Vars[i])
+		if r, ok := action.Vars[i].(rune); ok {
+			v = string(r)
+		}
+		cmd = strings.ReplaceAll(cmd, "$"+strconv.Itoa(i), v)
+	}
+	return cmd
+}
+
+func TestPathLength(t *testing.T) {
+	vm := NewVM(MustCompile(Seq(Star(AnyRune()), Cap(MustKeys("x"), "x"), End())))
+	for _, ev := range keys(strings.Repeat("a", 1000)) {
+		vm.Exec(ev)
+	}
+	// only prioritized choices are recorded, so the paths do not grow with
+	// the loop
+	for _, m := range vm.machines {
+		if len(m.path) != 0 {
+			t.Fatalf("got a path of %d branches, expected none", len(m.path))
+		}
+	}
+}
+
+func TestRefeed(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    Policy
+		p         Pattern
+		input     string
+		expect    []string
+		discarded string
+	}{
+		{"prefix", FirstMatch, Alt(Cap(MustKeys("dw"), "dw"), Cap(MustKeys("x"), "x")), "dx", []string{"x"}, "d"},
+		{"after match", FirstMatch, Alt(Cap(MustKeys("gg"), "a"), Cap(MustKeys("g"), "b")), "gx", []string{"b"}, "x"},
+		{"unknown", FirstMatch, Cap(MustKeys("x"), "x"), "yxzx", []string{"x", "x"}, "yz"},
+		{"longest", LongestMatch, Alt(Cap(MustKeys("abc"), "abc"), Cap(MustKeys("b"), "b")), "abx", []string{"b"}, "ax"},
+		{"empty", FirstMatch, Cap(Opt(MustKeys("x")), "empty"), "a", []string{"empty"}, "a"},
+		{"longest empty", LongestMatch, Cap(Opt(MustKeys("x")), "empty"), "ax", []string{"empty", "empty"}, "a"},
+		{"discard in leftover", FirstMatch, Alt(Cap(MustKeys("a"), "A"), Cap(MustKeys("abcd"), "ABCD"), Cap(MustKeys("c"), "C")), "abcy", []string{"A", "C"}, "by"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewVM(MustCompile(Seq(tt.p, End())))
+			vm.SetPolicy(tt.policy)
+			var cmds []string
+			var discarded string
+			for _, ev := range keys(tt.input) {
+				action, ok, more := vm.Exec(ev)
+				for ok {
+					cmds = append(cmds, action.Cmd)
+					action, ok = vm.Next()
+				}
+				for _, ev := range vm.Discarded() {
+					discarded += ev2str(ev)
+				}
+				if !more {
+					vm.Reset()
+				}
+			}
+			if !reflect.DeepEqual(cmds, tt.expect) {
+				t.Fatalf("got %q, expected %q", cmds, tt.expect)
+			}
+			if discarded != tt.discarded {
+				t.Fatalf("discarded %q, expected %q", discarded, tt.discarded)
+			}
+		})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	p := Seq(Cap(Seq(Star(Star(AnyRune())), MustKeys("x")), "$0"), End())
+	vm := NewVM(MustCompile(p))
+	for _, ev := range keys("abcabcabc") {
+		vm.Exec(ev)
+		if len(vm.machines) > 2 {
+			t.Fatalf("got %d machines, expected at most 2", len(vm.machines))
+		}
+	}
+	action, ok, _ := vm.Exec(keys("x")[0])
+	if !ok || expandVars(action) != "{a b c a b c a b c x}" {
+		t.Fatalf("got ok=%v cmd=%q", ok, expandVars(action))
+	}
+
+	// ambiguous alternatives collapse into the one with the highest priority
+	p = Seq(Star(Alt(Cap(AnyRune(), "a"), Cap(AnyRune(), "b"))), MustKeys("x"), End())
+	vm = NewVM(MustCompile(p))
+	for _, ev := range keys("abcabcabc") {
+		vm.Exec(ev)
+	}
+	// one machine per consume: 'a', 'b' and 'x'
+	if len(vm.machines) > 3 {
+		t.Fatalf("got %d machines, expected at most 3", len(vm.machines))
+	}
+
+	vm = NewVM(MustCompile(Seq(Alt(MustKeys("ab"), MustKeys("ac"), MustKeys("ad")), End())))
+	vm.SetMaxMachines(2)
+	vm.Exec(keys("a")[0])
+	if len(vm.machines) != 2 {
+		t.Fatalf("got %d machines, expected the limit of 2", len(vm.machines))
+	}
+}
+
+func BenchmarkNestedStar(b *testing.B) {
+	prog := MustCompile(Seq(Cap(Seq(Star(Opt(Star(AnyRune()))), MustKeys("x")), "x"), End()))
+	evs := keys(strings.Repeat("abcdefgh", 8) + "x")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm := NewVM(prog)
+		for _, ev := range evs {
+			vm.Exec(ev)
+		}
+	}
+}
+
+func BenchmarkAmbiguous(b *testing.B) {
+	prog := MustCompile(Seq(Cap(Seq(Star(Alt(Cap(AnyRune(), "a"), Cap(AnyRune(), "b"))), MustKeys("x")), "x"), End()))
+	evs := keys(strings.Repeat("ab", 32) + "x")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm := NewVM(prog)
+		for _, ev := range evs {
+			vm.Exec(ev)
+		}
+	}
+}
+
+// flat returns a keymap made of single key bindings, like micro.kbd.
+func flat() Pattern {
+	var bindings []Pattern
+	for _, k := range []string{"ctrl+s", "ctrl+q", "ctrl+z", "ctrl+y", "up", "down", "left", "right", "enter", "backspace"} {
+		bindings = append(bindings, Cap(MustKeys(k), "command "+k))
+	}
+	for _, r := range " abcdefghijklmnopqrstuvwxyz" {
+		bindings = append(bindings, Cap(MustKeys(string(r)), "insert "+string(r)))
+	}
+	return Seq(Alt(bindings...), End())
+}
+
+// run feeds the events to the VM like an editor would, resetting it whenever
+// nothing is pending.
+func run(vm Executor, evs []tcell.Event) {
+	for _, ev := range evs {
+		action, ok, more := vm.Exec(ev)
+		for ok {
+			action, ok = vm.Next()
+		}
+		_ = action
+		if !more {
+			vm.Reset()
+		}
+	}
+}
+
+func TestForgetCalls(t *testing.T) {
+	// nested brackets of two kinds give a different return stack for every
+	// sequence of openings
+	g := Grammar("top", map[string]Pattern{
+		"top":    Alt(Cap(MustKeys("x"), "x"), NonTerm("paren"), NonTerm("square")),
+		"paren":  Seq(MustKeys("("), NonTerm("top"), MustKeys(")")),
+		"square": Seq(MustKeys("["), NonTerm("top"), MustKeys("]")),
+	})
+	vm := NewVM(MustCompile(Seq(g, End())))
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		var open, close string
+		for j := 0; j < 10; j++ {
+			if rnd.Intn(2) == 0 {
+				open, close = open+"(", ")"+close
+			} else {
+				open, close = open+"[", "]"+close
+			}
+		}
+		run(vm, keys(open+"x"+close))
+	}
+	if n := len(vm.pool.calls); n > 10 {
+		t.Fatalf("%d return stacks are still interned", n)
+	}
+}
+
+func TestExecAllocs(t *testing.T) {
+	vm := NewVM(MustCompile(flat()))
+	evs := keys("hello world")
+	run(vm, evs)
+	allocs := testing.AllocsPerRun(100, func() {
+		run(vm, evs)
+	})
+	if allocs != 0 {
+		t.Fatalf("got %v allocations, expected none", allocs)
+	}
+}
+
+func BenchmarkKeyRepeat(b *testing.B) {
+	vm := NewVM(MustCompile(flat()))
+	evs := keys("j")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		run(vm, evs)
+	}
+}
+
+func BenchmarkPaste(b *testing.B) {
+	vm := NewVM(MustCompile(flat()))
+	evs := keys(strings.Repeat("the quick brown fox jumps over the lazy dog", 4))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		run(vm, evs)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	prog := MustCompile(Seq(Alt(
+		Cap(Seq(MustKeys("m"), Lit(&MouseEvent{btn: tcell.Button1})), "click $0"),
+		Cap(Seq(MustKeys("r"), AnyRune()), "replace $0"),
+		Cap(Seq(MustKeys("p"), Lit(&PasteEvent{})), "paste $0"),
+	), End()))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vm := NewVM(prog)
+			for j := 0; j < 100; j++ {
+				r := rune('a' + (i+j)%26)
+				evs := []tcell.Event{
+					tcell.NewEventKey(tcell.KeyRune, 'm', tcell.ModNone),
+					tcell.NewEventMouse(i, j, tcell.Button1, tcell.ModNone),
+					tcell.NewEventKey(tcell.KeyRune, 'r', tcell.ModNone),
+					tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone),
+					tcell.NewEventKey(tcell.KeyRune, 'p', tcell.ModNone),
+					tcell.NewEventPaste(fmt.Sprint(j)),
+				}
+				var cmds []string
+				for _, ev := range evs {
+					if action, ok, more := vm.Exec(ev); ok {
+						cmds = append(cmds, expandVars(action))
+					} else if !more {
+						vm.Reset()
+					}
+				}
+				expect := []string{
+					fmt.Sprintf("click {m {%d %d}}", i, j),
+					fmt.Sprintf("replace {r %c}", r),
+					fmt.Sprintf("paste {p %d}", j),
+				}
+				if !reflect.DeepEqual(cmds, expect) {
+					errs <- fmt.Errorf("session %d: got %q, expected %q", i, cmds, expect)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestTypedVars(t *testing.T) {
+	mouse := tcell.NewEventMouse(3, 4, tcell.Button1, tcell.ModCtrl)
+	resize := tcell.NewEventResize(80, 24)
+	enter := tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone)
+	count := keys("d12G")
+	tests := []struct {
+		name   string
+		p      Pattern
+		evs    []tcell.Event
+		expect interface{}
+	}{
+		{"rune", Cap(AnyRune(), "$0"), keys("x"), 'x'},
+		{"mouse", Cap(MustLit("ctrl+mouseleft"), "$0"), []tcell.Event{mouse}, Position{3, 4, tcell.Button1, tcell.ModCtrl}},
+		{"paste", Cap(MustLit("paste"), "$0"), []tcell.Event{tcell.NewEventPaste("text")}, "text"},
+		{"resize", Cap(MustLit("resize"), "$0"), []tcell.Event{resize}, Size{80, 24}},
+		{"key", Cap(MustLit("enter"), "$0"), []tcell.Event{enter}, enter},
+		{"events", Cap(Seq(Lit(&ResizeEvent{}), MustKeys("enter")), "$0"), []tcell.Event{resize, enter}, Events{resize, enter}},
+		{"arg", Cap(Seq(MustKeys("d"), Arg(Plus(RangeRune('0', '9'))), MustKeys("G")), "$1"), count, Events{count[1], count[2]}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewVM(MustCompile(Seq(tt.p, End())))
+			var action Action
+			var ok bool
+			for _, ev := range tt.evs {
+				action, ok, _ = vm.Exec(ev)
+			}
+			if !ok || len(action.Vars) != 1 {
+				t.Fatalf("got ok=%v vars=%v", ok, action.Vars)
+			}
+			if !reflect.DeepEqual(action.Vars[0], tt.expect) {
+				t.Fatalf("got %#v, expected %#v", action.Vars[0], tt.expect)
+			}
+		})
+	}
+
+	if text := Events(keys("ab")).Text(); text != "ab" {
+		t.Fatalf("got %q, expected %q", text, "ab")
+	}
+}
+
+func TestTree(t *testing.T) {
+	g := Rules("top",
+		Rule{"top", Cap(Seq(Named("count", Plus(RangeRune('0', '9'))), Arg(NonTerm("move"))), "repeat -n $count $2")},
+		Rule{"move", Alt(Cap(MustKeys("w"), "word-front"), Cap(Seq(MustKeys("f"), Arg(AnyRune())), "find-char $1"))},
+	)
+	prog := MustCompile(Seq(g, End()))
+	evs := keys("12fx")
+
+	count := &Node{Value: Events{evs[0], evs[1]}}
+	expect := &Node{
+		Template: "repeat -n $count $2",
+		Args: []*Node{count, {
+			Template: "find-char $1",
+			Args:     []*Node{{Value: 'x'}},
+			Value:    Events{evs[2], evs[3]},
+		}},
+		Named: map[string]*Node{"count": count},
+		Value: Events(evs),
+	}
+
+	vm := NewVM(prog)
+	d, err := NewDFA(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ex := range []interface {
+		Executor
+		SetTree(bool)
+	}{vm, d} {
+		var action Action
+		for _, ev := range evs {
+			action, _, _ = ex.Exec(ev)
+		}
+		if action.Tree != nil {
+			t.Fatalf("got a tree without SetTree")
+		}
+		ex.Reset()
+		ex.SetTree(true)
+		for _, ev := range evs {
+			action, _, _ = ex.Exec(ev)
+		}
+		if !reflect.DeepEqual(action.Tree, expect) {
+			t.Fatalf("got %+v, expected %+v", action.Tree, expect)
+		}
+	}
+}